@@ -0,0 +1,139 @@
+// Package batch runs erase, program and verify jobs on several MTD devices
+// concurrently, e.g., to provision the flash chips of a board in one go.
+//
+// A Job is a sequence of steps on one mtdabi.Flash. Run runs jobs with
+// bounded parallelism, reports the progress of each job, and collects the
+// errors of the failed jobs into an Error keyed by job name.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// Job is a sequence of steps on one device.
+type Job struct {
+	// Name identifies the job in progress reports and errors, e.g., the
+	// path of the device. Names must be unique within a batch.
+	Name  string
+	Flash mtdabi.Flash
+	// Steps run in order; the job stops at the first failing step.
+	Steps []Step
+}
+
+// Progress is the progress of a job.
+type Progress struct {
+	Job string
+	// Step is the index of the running step.
+	Step int
+	// Done and Total are the numbers of bytes processed and to process by
+	// all the steps of the job.
+	Done, Total int64
+}
+
+// Options controls Run.
+type Options struct {
+	// Parallel is the maximum number of jobs running at once. 0 means all
+	// jobs run at once.
+	Parallel int
+	// Progress, if set, is called as the jobs advance, from one goroutine
+	// at a time.
+	Progress func(p Progress)
+}
+
+// Error reports the errors of the failed jobs of a batch, by job name.
+type Error map[string]error
+
+func (e Error) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%v: %v", name, e[name])
+	}
+	return fmt.Sprintf("%v of the jobs failed: %v", len(e), strings.Join(msgs, "; "))
+}
+
+// Run runs jobs and returns an Error if any of them fails. Cancelling ctx
+// stops the running jobs between chunks of work, and fails the jobs not
+// started yet.
+func Run(ctx context.Context, jobs []Job, opts Options) error {
+	names := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		if job.Name == "" || names[job.Name] {
+			return fmt.Errorf("job name '%v' empty or not unique", job.Name)
+		}
+		names[job.Name] = true
+	}
+	parallel := opts.Parallel
+	if parallel <= 0 || parallel > len(jobs) {
+		parallel = len(jobs)
+	}
+
+	var mu sync.Mutex
+	failed := make(Error)
+	report := func(p Progress) {
+		if opts.Progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		opts.Progress(p)
+	}
+	queue := make(chan Job)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				err := ctx.Err()
+				if err == nil {
+					err = runJob(ctx, job, report)
+				}
+				if err != nil {
+					mu.Lock()
+					failed[job.Name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// runJob runs the steps of job in order.
+func runJob(ctx context.Context, job Job, report func(Progress)) error {
+	p := Progress{Job: job.Name}
+	for _, step := range job.Steps {
+		p.Total += step.Size()
+	}
+	report(p)
+	for i, step := range job.Steps {
+		p.Step = i
+		err := step.Run(ctx, job.Flash, func(n int64) {
+			p.Done += n
+			report(p)
+		})
+		if err != nil {
+			return fmt.Errorf("step %v: %w", i, err)
+		}
+	}
+	return nil
+}
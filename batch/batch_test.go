@@ -0,0 +1,146 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+	"golang.org/x/sys/unix"
+)
+
+// parallelStep records how many jobs run it at once.
+type parallelStep struct {
+	mu           sync.Mutex
+	running, max int
+}
+
+func (s *parallelStep) Size() int64 {
+	return 0
+}
+
+func (s *parallelStep) Run(ctx context.Context, f mtdabi.Flash, advance func(n int64)) error {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.max {
+		s.max = s.running
+	}
+	s.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	size := int64(mtdsim.SmallNAND.Size)
+	image := bytes.Repeat([]byte{0x5a}, 0x6000)
+	parallel := &parallelStep{}
+	var sims []*mtdsim.Sim
+	var jobs []Job
+	for i := 0; i < 4; i++ {
+		sim := mtdsim.NewSmallNAND()
+		// Dirty the flash, so the erase matters
+		_, err := sim.WriteAt(make([]byte, mtdsim.SmallNAND.Erasesize), 0)
+		if err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		sims = append(sims, sim)
+		jobs = append(jobs, Job{
+			Name:  fmt.Sprintf("mtd%d", i),
+			Flash: sim,
+			Steps: []Step{parallel, Erase(0, size), Program(0x200, image), Verify(0x200, image)},
+		})
+	}
+	// The third device fails to program its second eraseblock
+	err := sims[2].Inject(mtdsim.Fault{Kind: mtdsim.FaultProgram, Offset: int64(mtdsim.SmallNAND.Erasesize)})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+
+	// Progress is reported from one goroutine at a time
+	last := make(map[string]Progress)
+	opts := Options{
+		Parallel: 2,
+		Progress: func(p Progress) {
+			if prev, ok := last[p.Job]; ok && p.Done < prev.Done {
+				t.Errorf("Progress of %v went back from %v to %v", p.Job, prev.Done, p.Done)
+			}
+			last[p.Job] = p
+		},
+	}
+	err = Run(context.Background(), jobs, opts)
+	var batchErr Error
+	if !errors.As(err, &batchErr) || len(batchErr) != 1 || batchErr["mtd2"] == nil {
+		t.Fatalf("Run: want an error for mtd2 only got '%v'", err)
+	}
+	if !errors.Is(batchErr["mtd2"], unix.EIO) {
+		t.Errorf("mtd2 error: want '%v' got '%v'", unix.EIO, batchErr["mtd2"])
+	}
+	if parallel.max != 2 {
+		t.Errorf("Parallelism: want 2 jobs running got %v", parallel.max)
+	}
+	total := size + 2*int64(len(image))
+	for _, name := range []string{"mtd0", "mtd1", "mtd3"} {
+		if p := last[name]; p.Done != total || p.Total != total || p.Step != 3 {
+			t.Errorf("Progress of %v: want %v bytes done in step 3 got '%+v'", name, total, p)
+		}
+	}
+	if p := last["mtd2"]; p.Step != 2 || p.Done != size+int64(mtdsim.SmallNAND.Erasesize)-0x200 {
+		t.Errorf("Progress of mtd2: unexpected '%+v'", p)
+	}
+
+	// Verification catches differences
+	sims[2].ClearFaults()
+	jobs = []Job{{Name: "mtd2", Flash: sims[2], Steps: []Step{Verify(0x200, image)}}}
+	err = Run(context.Background(), jobs, Options{})
+	if !errors.Is(err.(Error)["mtd2"], ErrVerify) {
+		t.Errorf("Verify: want '%v' got '%v'", ErrVerify, err)
+	}
+
+	// Bad eraseblocks are skipped, the image shifting to the third
+	// eraseblock, and corrected bitflips pass verification
+	erasesize := int64(mtdsim.SmallNAND.Erasesize)
+	sim := mtdsim.NewSmallNAND(erasesize)
+	err = sim.Inject(mtdsim.Fault{Kind: mtdsim.FaultBitflips, Offset: 2 * erasesize, Bitflips: 1})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	steps := []Step{Erase(0, size), Program(0x200, image), Verify(0x200, image)}
+	err = Run(context.Background(), []Job{{Name: "bad", Flash: sim, Steps: steps}}, Options{})
+	if err != nil {
+		t.Errorf("Run with bad eraseblock failed: %v", err)
+	}
+	sim.ClearFaults()
+	buf := make([]byte, len(image)-int(erasesize-0x200))
+	_, err = sim.ReadAt(buf, 2*erasesize)
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, image[erasesize-0x200:]) {
+		t.Errorf("Data after bad eraseblock not shifted")
+	}
+	big := make([]byte, size-erasesize+1)
+	err = Run(context.Background(), []Job{{Name: "big", Flash: sim, Steps: []Step{Program(0, big)}}}, Options{})
+	if !errors.Is(err.(Error)["big"], mtdabi.ErrOutOfBounds) {
+		t.Errorf("Program past the end: want '%v' got '%v'", mtdabi.ErrOutOfBounds, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Run(ctx, []Job{{Name: "cancelled", Flash: sim, Steps: []Step{Erase(0, size)}}}, Options{})
+	if !errors.Is(err.(Error)["cancelled"], context.Canceled) {
+		t.Errorf("Cancelled run: want '%v' got '%v'", context.Canceled, err)
+	}
+
+	err = Run(context.Background(), []Job{{Name: "a", Flash: sim}, {Name: "a", Flash: sim}}, Options{})
+	if err == nil {
+		t.Errorf("Run with duplicate names succeeded")
+	}
+}
@@ -0,0 +1,173 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// ErrVerify means the data read back differs from the data expected, to be
+// tested with errors.Is.
+var ErrVerify = errors.New("verification failed")
+
+// Step is an operation of a job. The steps below work an eraseblock at a time,
+// checking for cancellation in between, and skip bad eraseblocks.
+type Step interface {
+	// Size returns the number of bytes the step processes.
+	Size() int64
+	// Run runs the step on f, calling advance with the number of bytes
+	// processed as it goes.
+	Run(ctx context.Context, f mtdabi.Flash, advance func(n int64)) error
+}
+
+// Erase returns a step erasing length bytes at start, which must be aligned
+// to eraseblocks. Bad eraseblocks are skipped.
+func Erase(start, length int64) Step {
+	return &eraseStep{start: start, length: length}
+}
+
+type eraseStep struct {
+	start, length int64
+}
+
+func (s *eraseStep) Size() int64 {
+	return s.length
+}
+
+func (s *eraseStep) Run(ctx context.Context, f mtdabi.Flash, advance func(n int64)) error {
+	err := f.Geometry().CheckErase(s.start, s.length)
+	if err != nil {
+		return err
+	}
+	blocks, err := f.Geometry().Blocks(s.start, s.length)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		bad, err := f.IsBad(b.Offset)
+		if err != nil {
+			return fmt.Errorf("checking eraseblock at 0x%x: %w", b.Offset, err)
+		}
+		if !bad {
+			err = f.Erase(b.Offset, b.Size)
+			if err != nil {
+				return fmt.Errorf("erasing 0x%x: %w", b.Offset, err)
+			}
+		}
+		advance(b.Size)
+	}
+	return nil
+}
+
+// Program returns a step writing data at offset, which must have been erased.
+// Like nandwrite, bad eraseblocks are skipped and the data shifted to the next
+// good eraseblock.
+func Program(offset int64, data []byte) Step {
+	return &programStep{offset: offset, data: data}
+}
+
+type programStep struct {
+	offset int64
+	data   []byte
+}
+
+func (s *programStep) Size() int64 {
+	return int64(len(s.data))
+}
+
+func (s *programStep) Run(ctx context.Context, f mtdabi.Flash, advance func(n int64)) error {
+	return chunks(ctx, f, s.offset, s.data, func(offset int64, chunk []byte) error {
+		_, err := f.WriteAt(chunk, offset)
+		if err != nil {
+			return fmt.Errorf("writing 0x%x: %w", offset, err)
+		}
+		advance(int64(len(chunk)))
+		return nil
+	})
+}
+
+// Verify returns a step reading the flash back at offset and comparing it
+// with data, skipping bad eraseblocks as Program does. Bitflips corrected by
+// ECC are fine.
+func Verify(offset int64, data []byte) Step {
+	return &verifyStep{offset: offset, data: data}
+}
+
+type verifyStep struct {
+	offset int64
+	data   []byte
+}
+
+func (s *verifyStep) Size() int64 {
+	return int64(len(s.data))
+}
+
+func (s *verifyStep) Run(ctx context.Context, f mtdabi.Flash, advance func(n int64)) error {
+	return chunks(ctx, f, s.offset, s.data, func(offset int64, chunk []byte) error {
+		buf := make([]byte, len(chunk))
+		_, err := f.ReadAt(buf, offset)
+		if err != nil && err != unix.EUCLEAN {
+			return fmt.Errorf("reading 0x%x: %w", offset, err)
+		}
+		if !bytes.Equal(buf, chunk) {
+			i := 0
+			for buf[i] == chunk[i] {
+				i++
+			}
+			return fmt.Errorf("%w at 0x%x", ErrVerify, offset+int64(i))
+		}
+		advance(int64(len(chunk)))
+		return nil
+	})
+}
+
+// chunks calls fn on the parts of data at offset within each good
+// eraseblock, in order, checking for cancellation in between. Bad eraseblocks
+// are skipped and the data shifted to the next good one; if the eraseblock
+// containing offset is bad, the data starts at the same offset in the next
+// good one.
+func chunks(ctx context.Context, f mtdabi.Flash, offset int64, data []byte, fn func(offset int64, chunk []byte) error) error {
+	g := f.Geometry()
+	b, err := g.BlockAt(offset)
+	if err != nil {
+		return err
+	}
+	skip := offset - b.Offset
+	for len(data) > 0 {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		bad, err := f.IsBad(b.Offset)
+		if err != nil {
+			return fmt.Errorf("checking eraseblock at 0x%x: %w", b.Offset, err)
+		}
+		if !bad {
+			n := b.Size - skip
+			if n > int64(len(data)) {
+				n = int64(len(data))
+			}
+			err = fn(b.Offset+skip, data[:n])
+			if err != nil {
+				return err
+			}
+			data, skip = data[n:], 0
+		}
+		if len(data) == 0 {
+			break
+		}
+		b, err = g.BlockAt(b.End())
+		if err != nil {
+			return fmt.Errorf("0x%x bytes left past bad eraseblocks: %w", len(data), err)
+		}
+	}
+	return nil
+}
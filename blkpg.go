@@ -0,0 +1,66 @@
+package mtdabi
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BlkpgDevnameLen is the size of the partition name buffer of BLKPG, which
+// includes the terminating NUL (BLKPG_DEVNAMELTH)
+const BlkpgDevnameLen = 64
+
+// Blkpg adds or deletes a partition of an MTD at runtime. Only MTD master
+// devices accept it.
+//
+// #define BLKPG _IO(0x12,105)
+func Blkpg(fd uintptr, value *unix.BlkpgIoctlArg) error {
+	return ioctl(fd, unix.BLKPG, uintptr(unsafe.Pointer(value)))
+}
+
+// AddPartition creates a partition named name of length bytes at start using
+// BLKPG_ADD_PARTITION. The partition must be aligned to eraseblocks; the
+// kernel would otherwise make it read-only. The new partition gets the next
+// free MTD number, which can be found by its name in sysfs.
+func (d *Device) AddPartition(name string, start, length int64) error {
+	if name == "" || len(name) >= BlkpgDevnameLen {
+		return fmt.Errorf("partition name %q: length must be between 1 and %v", name, BlkpgDevnameLen-1)
+	}
+	if !d.NoValidate {
+		err := d.geometry.CheckErase(start, length)
+		if err != nil {
+			return err
+		}
+	}
+	part := unix.BlkpgPartition{
+		Start:  start,
+		Length: length,
+	}
+	copy(part.Devname[:], name)
+	return d.blkpg(unix.BLKPG_ADD_PARTITION, &part)
+}
+
+// DelPartition removes the partition with MTD number mtdNum from this master
+// device using BLKPG_DEL_PARTITION.
+func (d *Device) DelPartition(mtdNum int) error {
+	if mtdNum < 0 {
+		return fmt.Errorf("invalid MTD number %v", mtdNum)
+	}
+	part := unix.BlkpgPartition{Pno: int32(mtdNum)}
+	return d.blkpg(unix.BLKPG_DEL_PARTITION, &part)
+}
+
+// blkpg issues the BLKPG operation op on part.
+func (d *Device) blkpg(op int32, part *unix.BlkpgPartition) error {
+	value := unix.BlkpgIoctlArg{
+		Op:      op,
+		Datalen: int32(unsafe.Sizeof(*part)),
+		Data:    (*byte)(unsafe.Pointer(part)),
+	}
+	defer d.lockWrite()()
+	err := Blkpg(d.Fd(), &value)
+	runtime.KeepAlive(part)
+	return err
+}
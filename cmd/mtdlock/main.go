@@ -0,0 +1,103 @@
+// Command mtdlock shows and changes the lock status of the eraseblocks of an
+// MTD device, e.g., for provisioning the write protection of SPI-NOR flash.
+//
+// Usage:
+//
+//	mtdlock status|lock|unlock [-offset N] [-length N] /dev/mtdX
+//
+// Offsets and lengths may be given in decimal or with a 0x prefix; ranges are
+// widened to the eraseblocks they overlap. A length of 0 means up to the end
+// of the device. After lock and unlock, the resulting status is printed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	action := os.Args[1]
+	switch action {
+	case "status", "lock", "unlock":
+	default:
+		usage()
+	}
+	flags := flag.NewFlagSet("mtdlock "+action, flag.ExitOnError)
+	offset := flags.Int64("offset", 0, "start of the range")
+	length := flags.Int64("length", 0, "length of the range (0 means up to the end of the device)")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	err := run(action, flags.Arg(0), *offset, *length)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mtdlock:", err)
+		os.Exit(1)
+	}
+}
+
+// run applies action to the range of the device at path and prints the
+// resulting lock status.
+func run(action, path string, offset, length int64) error {
+	dev, err := mtdabi.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if length == 0 {
+		length = dev.Geometry().Size - offset
+	}
+	switch action {
+	case "lock":
+		err = dev.Lock(offset, length)
+	case "unlock":
+		err = dev.Unlock(offset, length)
+	}
+	if err != nil {
+		return err
+	}
+
+	status, err := dev.LockStatus(offset, length)
+	if err != nil {
+		return err
+	}
+	blocks, err := dev.Geometry().Blocks(offset, length)
+	if err != nil {
+		return err
+	}
+	render(os.Stdout, blocks, status)
+	return nil
+}
+
+// render prints one line per eraseblock with its lock status, followed by a
+// summary line.
+func render(w io.Writer, blocks []mtdabi.Block, status map[int64]bool) {
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+	locked := 0
+	for _, b := range blocks {
+		state := "unlocked"
+		if status[b.Offset] {
+			state = "locked"
+			locked++
+		}
+		fmt.Fprintf(w, "0x%08x-0x%08x  %s\n", b.Offset, b.End(), state)
+	}
+	fmt.Fprintf(w, "%d of %d eraseblocks locked\n", locked, len(blocks))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mtdlock status|lock|unlock [-offset N] [-length N] /dev/mtdX")
+	os.Exit(2)
+}
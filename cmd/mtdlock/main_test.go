@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+func TestRender(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		blocks []mtdabi.Block
+		status map[int64]bool
+		want   string
+	}{
+		{
+			name: "empty",
+			want: "0 of 0 eraseblocks locked\n",
+		},
+		{
+			name:   "unsorted",
+			blocks: []mtdabi.Block{{Offset: 0x10000, Size: 0x10000}, {Offset: 0, Size: 0x10000}},
+			status: map[int64]bool{0x10000: true},
+			want: "0x00000000-0x00010000  unlocked\n" +
+				"0x00010000-0x00020000  locked\n" +
+				"1 of 2 eraseblocks locked\n",
+		},
+		{
+			name:   "all locked",
+			blocks: []mtdabi.Block{{Offset: 0, Size: 0x1000}, {Offset: 0x1000, Size: 0x10000}},
+			status: map[int64]bool{0: true, 0x1000: true},
+			want: "0x00000000-0x00001000  locked\n" +
+				"0x00001000-0x00011000  locked\n" +
+				"2 of 2 eraseblocks locked\n",
+		},
+		{
+			// Blocks missing from status are unlocked
+			name:   "no status",
+			blocks: []mtdabi.Block{{Offset: 0x20000, Size: 0x10000}},
+			want: "0x00020000-0x00030000  unlocked\n" +
+				"0 of 1 eraseblocks locked\n",
+		},
+	} {
+		var buf bytes.Buffer
+		render(&buf, tc.blocks, tc.status)
+		if buf.String() != tc.want {
+			t.Errorf("%v: want '%v' got '%v'", tc.name, tc.want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package mtdabi
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device is an opened MTD character device (e.g., `/dev/mtd0`) together with
+// its MTD characteristics. Unlike the raw ioctl helpers, the methods on Device
+// take Go slices and handle the pointer conversions needed by the kernel
+// structures, keeping the buffers alive for the duration of the call.
+//
+// Unless NoValidate is set, the methods check their arguments against the
+// device geometry before issuing any ioctl (see CheckErase, CheckWrite and
+// CheckOOB), so that mistakes are reported with a descriptive error instead
+// of a bare EINVAL from the kernel.
+//
+// A Device is safe for concurrent use: operations that modify the flash or
+// the state of the device, such as erases, writes and file mode changes, are
+// serialized, while reads run concurrently with each other. Exclusive gives a
+// goroutine sole access for longer operations. The raw ioctl helpers used on
+// Fd are not coordinated.
+type Device struct {
+	// NoValidate disables the pre-flight checks against the device geometry.
+	NoValidate bool
+
+	file     *os.File
+	info     unix.MtdInfo
+	geometry *Geometry
+	state    *deviceState
+	// held is set on the Device passed by Exclusive, whose methods run
+	// under the lock already held
+	held bool
+}
+
+// deviceState is the state of a Device shared with the Device passed by
+// Exclusive.
+type deviceState struct {
+	mu   sync.RWMutex
+	mode uintptr
+}
+
+// Open opens the MTD character device at path for reading and writing and
+// obtains its characteristics and erase regions using MEMGETINFO,
+// MEMGETREGIONCOUNT and MEMGETREGIONINFO.
+func Open(path string) (*Device, error) {
+	file, err := os.OpenFile(path, os.O_SYNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := NewDevice(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// NewDevice wraps an already opened MTD character device. The Device takes
+// ownership of file, which is closed by Close.
+func NewDevice(file *os.File) (*Device, error) {
+	dev := &Device{file: file, state: &deviceState{}}
+	err := MemGetInfo(file.Fd(), &dev.info)
+	if err != nil {
+		return nil, fmt.Errorf("MemGetInfo failed on '%v': %w", file.Name(), err)
+	}
+	dev.geometry, err = getGeometry(file.Fd(), dev.info)
+	if err != nil {
+		return nil, fmt.Errorf("'%v': %w", file.Name(), err)
+	}
+	return dev, nil
+}
+
+// Close closes the underlying MTD character device, once the operations in
+// progress are done.
+func (d *Device) Close() error {
+	defer d.lockWrite()()
+	return d.file.Close()
+}
+
+// Fd returns the file descriptor of the underlying MTD character device, for
+// use with the raw ioctl helpers.
+func (d *Device) Fd() uintptr {
+	return d.file.Fd()
+}
+
+// Info returns the MTD characteristics obtained when the device was opened.
+func (d *Device) Info() unix.MtdInfo {
+	return d.info
+}
+
+// Geometry returns the eraseblock layout of the device, taking its erase
+// regions into account.
+func (d *Device) Geometry() *Geometry {
+	return d.geometry
+}
+
+// ReadAt reads len(p) bytes of in-band data starting at offset off.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	defer d.lockRead()()
+	return d.file.ReadAt(p, off)
+}
+
+// WriteAt writes len(p) bytes of in-band data starting at offset off. The
+// region must have been erased beforehand.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if !d.NoValidate {
+		err := CheckWrite(d.info, off, len(p), 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer d.lockWrite()()
+	return d.file.WriteAt(p, off)
+}
+
+// Erase erases length bytes starting at start using MEMERASE64. The region
+// must be aligned to the eraseblocks of the erase regions it falls in.
+func (d *Device) Erase(start, length int64) error {
+	if !d.NoValidate {
+		err := d.geometry.CheckErase(start, length)
+		if err != nil {
+			return err
+		}
+	}
+	value := unix.EraseInfo64{
+		Start:  uint64(start),
+		Length: uint64(length),
+	}
+	defer d.lockWrite()()
+	return MemErase64(d.Fd(), &value)
+}
+
+// ReadOOB reads len(buf) bytes of out-of-band data of the page containing
+// offset into buf, using MEMREADOOB64.
+func (d *Device) ReadOOB(offset int64, buf []byte) error {
+	err := d.checkOOB(offset, len(buf))
+	if err != nil {
+		return err
+	}
+	value := unix.MtdOobBuf64{
+		Start:  uint64(offset),
+		Length: uint32(len(buf)),
+		Ptr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+	}
+	defer d.lockRead()()
+	err = MemReadOob64(d.Fd(), &value)
+	runtime.KeepAlive(buf)
+	return err
+}
+
+// WriteOOB writes buf to the out-of-band area of the page containing offset,
+// using MEMWRITEOOB64.
+func (d *Device) WriteOOB(offset int64, buf []byte) error {
+	err := d.checkOOB(offset, len(buf))
+	if err != nil {
+		return err
+	}
+	value := unix.MtdOobBuf64{
+		Start:  uint64(offset),
+		Length: uint32(len(buf)),
+		Ptr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+	}
+	defer d.lockWrite()()
+	err = MemWriteOob64(d.Fd(), &value)
+	runtime.KeepAlive(buf)
+	return err
+}
+
+// Write writes in-band data and/or out-of-band data starting at offset using
+// MEMWRITE, where mode is one of unix.MTD_OPS_PLACE_OOB, unix.MTD_OPS_AUTO_OOB
+// and unix.MTD_OPS_RAW. Either data or oob may be empty, but not both.
+func (d *Device) Write(offset int64, data, oob []byte, mode uint8) error {
+	if len(data) == 0 && len(oob) == 0 {
+		return fmt.Errorf("write at 0x%x: no data or OOB given", offset)
+	}
+	if !d.NoValidate {
+		err := CheckWrite(d.info, offset, len(data), len(oob))
+		if err != nil {
+			return err
+		}
+	}
+	value := unix.MtdWriteReq{
+		Start:  uint64(offset),
+		Len:    uint64(len(data)),
+		Ooblen: uint64(len(oob)),
+		Mode:   mode,
+	}
+	if len(data) > 0 {
+		value.Data = uint64(uintptr(unsafe.Pointer(&data[0])))
+	}
+	if len(oob) > 0 {
+		value.Oob = uint64(uintptr(unsafe.Pointer(&oob[0])))
+	}
+	defer d.lockWrite()()
+	err := MemWrite(d.Fd(), &value)
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(oob)
+	return err
+}
+
+// checkOOB checks that an OOB access of length bytes at offset is non-empty
+// and, unless NoValidate is set, that it passes CheckOOB.
+func (d *Device) checkOOB(offset int64, length int) error {
+	if length == 0 {
+		return fmt.Errorf("OOB access at 0x%x: empty buffer", offset)
+	}
+	if d.NoValidate {
+		return nil
+	}
+	return CheckOOB(d.info, offset, length)
+}
+
+// Exclusive runs fn with sole access to the device, for long operations such
+// as updating a whole partition: the operations of other goroutines wait
+// until fn returns. An exclusive advisory lock is also taken on the device
+// file with flock(2), so that other processes using Exclusive, or flock on
+// the same device, wait as well.
+//
+// fn must operate on the Device it is given, which shares the file and state
+// of d but does not lock; calling the methods of d from fn deadlocks.
+func (d *Device) Exclusive(fn func(dev *Device) error) error {
+	if d.held {
+		return fn(d)
+	}
+	return d.withLock(func(dev *Device) error {
+		fd := int(d.Fd())
+		err := unix.Flock(fd, unix.LOCK_EX)
+		if err != nil {
+			return fmt.Errorf("flock failed on '%v': %w", d.file.Name(), err)
+		}
+		err = fn(dev)
+		unlockErr := unix.Flock(fd, unix.LOCK_UN)
+		if err != nil {
+			return err
+		}
+		return unlockErr
+	})
+}
+
+// withLock runs fn with the device locked for writing, passing it a Device
+// whose methods do not lock, so that fn can combine several operations.
+func (d *Device) withLock(fn func(dev *Device) error) error {
+	if d.held {
+		return fn(d)
+	}
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	held := *d
+	held.held = true
+	return fn(&held)
+}
+
+// lockRead locks the device for reading and returns the function unlocking
+// it, to be deferred.
+func (d *Device) lockRead() func() {
+	if d.held {
+		return func() {}
+	}
+	d.state.mu.RLock()
+	return d.state.mu.RUnlock
+}
+
+// lockWrite locks the device for writing and returns the function unlocking
+// it, to be deferred.
+func (d *Device) lockWrite() func() {
+	if d.held {
+		return func() {}
+	}
+	d.state.mu.Lock()
+	return d.state.mu.Unlock
+}
@@ -0,0 +1,103 @@
+package mtdabi
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetFileMode sets the MTD file mode of the device using MTDFILEMODE (see "MTD
+// file modes"), and records it so that WithFileMode can restore it.
+func (d *Device) SetFileMode(mode uintptr) error {
+	defer d.lockWrite()()
+	err := MtdFileMode(d.Fd(), mode)
+	if err != nil {
+		return err
+	}
+	d.state.mode = mode
+	return nil
+}
+
+// FileMode returns the MTD file mode last set with SetFileMode, which is
+// unix.MTD_FILE_MODE_NORMAL for a newly opened device.
+func (d *Device) FileMode() uintptr {
+	defer d.lockRead()()
+	return d.state.mode
+}
+
+// WithFileMode runs fn with dev in the given MTD file mode, restoring the
+// previous file mode afterwards, even if fn fails. Other goroutines see the
+// file mode too; to keep them out meanwhile, call WithFileMode with the
+// Device passed by Exclusive.
+func WithFileMode(dev *Device, mode uintptr, fn func() error) error {
+	prev := dev.FileMode()
+	err := dev.SetFileMode(mode)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	restoreErr := dev.SetFileMode(prev)
+	if err != nil {
+		return err
+	}
+	return restoreErr
+}
+
+// ReadRawPage reads the page at offset together with its whole OOB area in
+// MTD_FILE_MODE_RAW, i.e., without ECC correction, so that bitflips are
+// returned as they are on the flash.
+func (d *Device) ReadRawPage(offset int64) (data, oob []byte, err error) {
+	if !d.NoValidate {
+		err = d.checkPage("raw page read", offset)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	data = make([]byte, d.info.Writesize)
+	oob = make([]byte, d.info.Oobsize)
+	err = d.withLock(func(d *Device) error {
+		return WithFileMode(d, unix.MTD_FILE_MODE_RAW, func() error {
+			_, err := d.file.ReadAt(data, offset)
+			if err != nil {
+				return err
+			}
+			if len(oob) == 0 {
+				return nil
+			}
+			return d.ReadOOB(offset, oob)
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, oob, nil
+}
+
+// WriteRawPage programs a whole page at offset together with up to Oobsize
+// bytes of OOB data in MTD_FILE_MODE_RAW, using MEMWRITE with MTD_OPS_RAW, so
+// that no ECC is computed and the OOB data is written as given.
+func (d *Device) WriteRawPage(offset int64, data, oob []byte) error {
+	if !d.NoValidate {
+		err := d.checkPage("raw page write", offset)
+		if err != nil {
+			return err
+		}
+		if len(data) != int(d.info.Writesize) || len(oob) > int(d.info.Oobsize) {
+			return fmt.Errorf("raw page write at 0x%x: %v bytes of data and %v bytes of OOB, want %v and at most %v",
+				offset, len(data), len(oob), d.info.Writesize, d.info.Oobsize)
+		}
+	}
+	return d.withLock(func(d *Device) error {
+		return WithFileMode(d, unix.MTD_FILE_MODE_RAW, func() error {
+			return d.Write(offset, data, oob, unix.MTD_OPS_RAW)
+		})
+	})
+}
+
+// checkPage checks that offset is the start of a page within the device.
+func (d *Device) checkPage(op string, offset int64) error {
+	if offset%int64(d.info.Writesize) != 0 {
+		return fmt.Errorf("%v offset 0x%x %w to write size 0x%x", op, offset, ErrUnaligned, d.info.Writesize)
+	}
+	return checkBounds(int64(d.info.Size), op, offset, int64(d.info.Writesize))
+}
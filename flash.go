@@ -0,0 +1,76 @@
+package mtdabi
+
+import (
+	"io"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Flash is the set of flash operations shared by Device and the simulated
+// and file-backed devices of package mtdsim, so that code written against it
+// runs unchanged on `/dev/mtdN`, in tests, and on image files.
+type Flash interface {
+	io.ReaderAt
+	io.WriterAt
+	// Info returns the MTD characteristics.
+	Info() unix.MtdInfo
+	// Geometry returns the eraseblock layout.
+	Geometry() *Geometry
+	// Erase erases length bytes starting at start, which must be aligned to
+	// eraseblocks.
+	Erase(start, length int64) error
+	// ReadOOB reads len(buf) bytes of out-of-band data of the page
+	// containing offset into buf.
+	ReadOOB(offset int64, buf []byte) error
+	// WriteOOB programs buf into the out-of-band area of the page containing
+	// offset.
+	WriteOOB(offset int64, buf []byte) error
+	// IsBad reports whether the eraseblock containing offset is bad.
+	IsBad(offset int64) (bool, error)
+	// MarkBad marks the eraseblock containing offset as bad.
+	MarkBad(offset int64) error
+	// ECCStats returns the counts of corrected and uncorrectable ECC errors
+	// and of bad blocks.
+	ECCStats() (unix.MtdEccStats, error)
+}
+
+var _ Flash = (*Device)(nil)
+
+// IsBad reports whether the eraseblock containing offset is bad, using
+// MEMGETBADBLOCK. Unlike MemGetBadBlock, it returns the status the kernel
+// reports as the ioctl return value. MTDs without bad blocks, e.g., NOR
+// flash, always report good blocks.
+func (d *Device) IsBad(offset int64) (bool, error) {
+	block, err := d.geometry.BlockAt(offset)
+	if err != nil {
+		return false, err
+	}
+	defer d.lockRead()()
+	r, err := ioctlRet(d.Fd(), unix.MEMGETBADBLOCK, uintptr(unsafe.Pointer(&block.Offset)))
+	if err != nil {
+		return false, err
+	}
+	return r == 1, nil
+}
+
+// MarkBad marks the eraseblock containing offset as bad using MEMSETBADBLOCK.
+// This cannot be undone.
+func (d *Device) MarkBad(offset int64) error {
+	block, err := d.geometry.BlockAt(offset)
+	if err != nil {
+		return err
+	}
+	defer d.lockWrite()()
+	return MemSetBadBlock(d.Fd(), &block.Offset)
+}
+
+// ECCStats returns the ECC statistics of the MTD using ECCGETSTATS. Reads
+// through the character device succeed even if bitflips were corrected or
+// data could not be corrected, so these counters are the only way to tell.
+func (d *Device) ECCStats() (unix.MtdEccStats, error) {
+	var value unix.MtdEccStats
+	defer d.lockRead()()
+	err := EccGetStats(d.Fd(), &value)
+	return value, err
+}
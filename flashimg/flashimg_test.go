@@ -0,0 +1,213 @@
+package flashimg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	erasesize = 0x4000
+	writesize = 0x200
+	oobsize   = 0x10
+)
+
+// testImage returns an image of pages pages, the i-th page filled with byte
+// i, except for the erased pages listed.
+func testImage(pages int, erasedPages ...int) []byte {
+	image := make([]byte, 0, pages*writesize)
+	for i := 0; i < pages; i++ {
+		page := bytes.Repeat([]byte{byte(i)}, writesize)
+		for _, e := range erasedPages {
+			if e == i {
+				page = bytes.Repeat([]byte{0xff}, writesize)
+			}
+		}
+		image = append(image, page...)
+	}
+	return image
+}
+
+func TestVerify(t *testing.T) {
+	sim := mtdsim.NewSmallNAND(erasesize)
+	// 40 pages from the second page, skipping the bad second eraseblock
+	image := testImage(40, 5)
+	opts := Options{Offset: writesize, SkipBad: true}
+	_, err := sim.WriteAt(image[:31*writesize], writesize)
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	_, err = sim.WriteAt(image[31*writesize:], 2*erasesize)
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	r, err := Verify(sim, bytes.NewReader(image), opts)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !r.OK() || r.First != -1 || r.Pages != 40 || r.ErasedPages != 1 || r.ProgrammedPages != 39 {
+		t.Errorf("Unexpected report '%+v'", r)
+	}
+	if len(r.BadBlocks) != 1 || r.BadBlocks[0] != erasesize {
+		t.Errorf("BadBlocks: want '[0x%x]' got '%v'", erasesize, r.BadBlocks)
+	}
+
+	// A bitflip in the erased page, and an image page longer than on flash
+	_, err = sim.WriteAt(append([]byte{0xef}, bytes.Repeat([]byte{0xff}, writesize-1)...), 6*writesize)
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	longer := append(image, testImage(2)...)
+	r, err = Verify(sim, bytes.NewReader(longer), opts)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if r.OK() || r.First != 6*writesize || r.Pages != 42 || r.ErasedPages != 2 {
+		t.Errorf("Unexpected report '%+v'", r)
+	}
+	want := []PageDiff{
+		{Offset: 6 * writesize, ImageOffset: 5 * writesize, Bitflips: 1, ErasedBitflips: 1, ImageErased: true},
+		// The page filled with 0 and the page filled with 1
+		{Offset: 2*erasesize + 9*writesize, ImageOffset: 40 * writesize, Bitflips: writesize * 8, Erased: true},
+		{Offset: 2*erasesize + 10*writesize, ImageOffset: 41 * writesize, Bitflips: writesize * 7, Erased: true},
+	}
+	if len(r.Diffs) != len(want) {
+		t.Fatalf("Diffs: want '%+v' got '%+v'", want, r.Diffs)
+	}
+	for i := range want {
+		if r.Diffs[i] != want[i] {
+			t.Errorf("Diff %v: want '%+v' got '%+v'", i, want[i], r.Diffs[i])
+		}
+	}
+
+	// Without skipping, the image is compared with the bad eraseblock
+	r, err = Verify(sim, bytes.NewReader(image), Options{Offset: writesize})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(r.Diffs) < 2 || r.Diffs[1].Offset != erasesize || len(r.BadBlocks) != 0 {
+		t.Errorf("Unexpected report '%+v'", r)
+	}
+
+	_, err = Verify(sim, bytes.NewReader(make([]byte, mtdsim.SmallNAND.Size)), opts)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("Verify too large: want '%v' got '%v'", ErrImageTooLarge, err)
+	}
+	_, err = Verify(sim, bytes.NewReader(image), Options{Offset: 1})
+	if err == nil {
+		t.Errorf("Verify at unaligned offset succeeded")
+	}
+}
+
+func TestVerifyOOB(t *testing.T) {
+	sim := mtdsim.NewSmallNAND()
+	var image []byte
+	for i := 0; i < 2; i++ {
+		oob := []byte{0xff, 0xff, 1, 2, 3, 4, 5, 6, 0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7}
+		image = append(image, bytes.Repeat([]byte{byte(i)}, writesize)...)
+		image = append(image, oob...)
+		// The ECC bytes differ, as well as a free byte of the second page
+		oob[9] = 0
+		if i == 1 {
+			oob[2] = 0
+		}
+		err := sim.Write(int64(i*writesize), image[i*(writesize+oobsize):i*(writesize+oobsize)+writesize], oob, unix.MTD_OPS_PLACE_OOB)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	opts := Options{OOB: true, OOBFree: []unix.NandOobfree{{Offset: 2, Length: 6}}}
+	r, err := Verify(sim, bytes.NewReader(image), opts)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	want := PageDiff{Offset: writesize, ImageOffset: writesize + oobsize, OOBBitflips: 1, ErasedBitflips: writesize * 7}
+	if r.Pages != 2 || len(r.Diffs) != 1 || r.Diffs[0] != want || r.First != writesize {
+		t.Errorf("Unexpected report '%+v'", r)
+	}
+
+	// Without free bytes, OOB areas are not compared
+	opts.OOBFree = nil
+	r, err = Verify(sim, bytes.NewReader(image), opts)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !r.OK() {
+		t.Errorf("Unexpected report '%+v'", r)
+	}
+	_, err = Verify(sim, bytes.NewReader(image[:writesize+1]), opts)
+	if err == nil {
+		t.Errorf("Verify of truncated image succeeded")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	sim := mtdsim.NewSmallNAND(erasesize)
+	_, err := sim.WriteAt(make([]byte, erasesize), 0)
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	// Empty pages, and a partial page at the end
+	image := append(testImage(40, 5, 6), 1, 2, 3)
+	err = sim.StartRecording()
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	opts := Options{SkipBad: true}
+	s, err := Write(sim, bytes.NewReader(image), opts)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	rec := sim.StopRecording()
+	if s.ErasedBlocks != 2 || s.WrittenPages != 39 || s.SkippedPages != 2 || len(s.BadBlocks) != 1 {
+		t.Errorf("Unexpected stats '%+v'", s)
+	}
+	for _, op := range rec.Ops {
+		if op.Kind == mtdsim.OpProgram && op.Offset < 7*writesize && op.Offset+op.Length > 5*writesize {
+			t.Errorf("Empty pages programmed by %v", op)
+		}
+	}
+	r, err := Verify(sim, bytes.NewReader(image), opts)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !r.OK() || r.ErasedPages != 2 {
+		t.Errorf("Unexpected report '%+v'", r)
+	}
+
+	// Pages with empty data but OOB are programmed
+	var oobImage []byte
+	for i := 0; i < 3; i++ {
+		oob := bytes.Repeat([]byte{0xff}, oobsize)
+		if i == 1 {
+			oob[3] = 0x12
+		}
+		oobImage = append(oobImage, bytes.Repeat([]byte{0xff}, writesize)...)
+		oobImage = append(oobImage, oob...)
+	}
+	s, err = Write(sim, bytes.NewReader(oobImage), Options{OOB: true})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if s.WrittenPages != 1 || s.SkippedPages != 2 {
+		t.Errorf("Unexpected stats '%+v'", s)
+	}
+	oob := make([]byte, oobsize)
+	err = sim.ReadOOB(writesize, oob)
+	if err != nil {
+		t.Fatalf("ReadOOB failed: %v", err)
+	}
+	if oob[3] != 0x12 {
+		t.Errorf("OOB not programmed: got '%x'", oob)
+	}
+
+	_, err = Write(sim, bytes.NewReader(image), Options{Offset: writesize})
+	if !errors.Is(err, mtdabi.ErrUnaligned) {
+		t.Errorf("Write at unaligned offset: want '%v' got '%v'", mtdabi.ErrUnaligned, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Package flashimg writes flash images to an MTD and verifies them, like
+// nandwrite and nanddump do, but with statistics and a structured report.
+//
+// An image is laid out on the flash from an offset, optionally skipping bad
+// eraseblocks, in which case the rest of the image moves to the next good
+// eraseblock. An image may hold the OOB area of each page after its data, as
+// written by nanddump --oob.
+package flashimg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// norPageSize is the size of the chunks NOR flash, which has no pages, is
+// handled in.
+const norPageSize = 512
+
+// ErrImageTooLarge means the image does not fit on the flash, to be tested with
+// errors.Is.
+var ErrImageTooLarge = errors.New("image too large")
+
+// Options describes the layout of an image on the flash.
+type Options struct {
+	// Offset is where the image starts on the flash. It must be aligned to
+	// pages, which are norPageSize bytes on NOR flash.
+	Offset int64
+	// SkipBad skips bad eraseblocks, as nandwrite does.
+	SkipBad bool
+	// OOB means the image holds the OOB area of each page after its data.
+	OOB bool
+	// OOBFree lists the OOB bytes compared, e.g., the Oobfree entries of
+	// EccGetLayout, the other ones holding ECC. OOB areas are compared only
+	// if the image holds them and OOBFree is not empty.
+	OOBFree []unix.NandOobfree
+}
+
+// chunk is the part of an image going to an eraseblock.
+type chunk struct {
+	// offset is where the chunk goes on the flash, and imageOffset where
+	// it starts in the image.
+	offset, imageOffset int64
+	// data is the data of whole pages, except at the end of the image.
+	data []byte
+	// oob holds the OOB area of each page, if the image holds them.
+	oob [][]byte
+}
+
+// pageSize returns the page size of the flash, or norPageSize for flash
+// without OOB and with smaller pages.
+func pageSize(info unix.MtdInfo) int64 {
+	size := int64(info.Writesize)
+	if info.Oobsize == 0 && size < norPageSize && int64(info.Erasesize)%norPageSize == 0 {
+		return norPageSize
+	}
+	return size
+}
+
+// walk reads image and calls fn with the chunk of each eraseblock it goes
+// to, in order. Bad eraseblocks skipped are passed to bad.
+func walk(f mtdabi.Flash, image io.Reader, opts Options, bad func(offset int64), fn func(c *chunk) error) error {
+	info := f.Info()
+	page := pageSize(info)
+	if opts.Offset < 0 || opts.Offset%page != 0 {
+		return fmt.Errorf("image offset 0x%x %w to page size 0x%x", opts.Offset, mtdabi.ErrUnaligned, page)
+	}
+	if opts.OOB && info.Oobsize == 0 {
+		return errors.New("image with OOB data for flash without OOB")
+	}
+	blocks, err := f.Geometry().Blocks(opts.Offset, int64(info.Size)-opts.Offset)
+	if err != nil {
+		return err
+	}
+	imageOffset := int64(0)
+	offset := opts.Offset
+	for _, b := range blocks {
+		if opts.SkipBad {
+			isBad, err := f.IsBad(b.Offset)
+			if err != nil {
+				return fmt.Errorf("checking eraseblock at 0x%x: %w", b.Offset, err)
+			}
+			if isBad {
+				bad(b.Offset)
+				offset = b.End()
+				continue
+			}
+		}
+		c := &chunk{offset: offset, imageOffset: imageOffset}
+		c.data = make([]byte, 0, b.End()-offset)
+		end := false
+		for p := offset; p < b.End(); p += page {
+			buf := c.data[len(c.data) : len(c.data)+int(page)]
+			n, err := io.ReadFull(image, buf)
+			c.data = c.data[:len(c.data)+n]
+			imageOffset += int64(n)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if n > 0 && opts.OOB {
+					return fmt.Errorf("image ends within the page at 0x%x", p)
+				}
+				end = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if opts.OOB {
+				oob := make([]byte, info.Oobsize)
+				_, err = io.ReadFull(image, oob)
+				if err != nil {
+					return fmt.Errorf("reading OOB of the page at 0x%x: %w", p, err)
+				}
+				imageOffset += int64(len(oob))
+				c.oob = append(c.oob, oob)
+			}
+		}
+		if len(c.data) > 0 {
+			err = fn(c)
+			if err != nil {
+				return err
+			}
+		}
+		if end {
+			return nil
+		}
+		offset = b.End()
+	}
+	_, err = io.ReadFull(image, make([]byte, 1))
+	if err == nil {
+		return fmt.Errorf("%w for the flash from 0x%x", ErrImageTooLarge, opts.Offset)
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package flashimg
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// Report is the result of comparing the flash with an image.
+type Report struct {
+	// Pages is the number of pages compared.
+	Pages int
+	// ErasedPages and ProgrammedPages count the pages compared that are
+	// fully erased on the flash, OOB included if compared, and the others.
+	ErasedPages, ProgrammedPages int
+	// BadBlocks lists the offsets of the bad eraseblocks skipped.
+	BadBlocks []int64
+	// Diffs lists the pages differing from the image, in order.
+	Diffs []PageDiff
+	// First is the offset on the flash of the first byte differing from the
+	// image, or -1. If only OOB areas differ, it is the offset of the page.
+	First int64
+	// Corrected and Failed are the numbers of ECC corrections and of
+	// uncorrectable ECC errors while reading, from ECCStats. Reads return
+	// data even if it could not be corrected.
+	Corrected, Failed uint32
+}
+
+// PageDiff is a page of the flash differing from the image.
+type PageDiff struct {
+	// Offset is the offset of the page on the flash, and ImageOffset its
+	// offset in the image.
+	Offset, ImageOffset int64
+	// Bitflips and OOBBitflips are the numbers of bits of the data and of
+	// the free OOB bytes differing from the image.
+	Bitflips, OOBBitflips int
+	// ErasedBitflips is the number of bits of the data of the page that are
+	// not erased. A low count on a page expected to be programmed means the
+	// page was not written.
+	ErasedBitflips int
+	// Erased and ImageErased report whether the page is fully erased on the
+	// flash and in the image.
+	Erased, ImageErased bool
+}
+
+// OK reports whether the flash matches the image.
+func (r *Report) OK() bool {
+	return len(r.Diffs) == 0
+}
+
+// Verify reads back the flash and compares it with image, laid out as
+// described by opts. Only the pages covered by the image are compared, and
+// only the bytes of the last page the image covers. Differences are
+// reported, not returned as errors.
+func Verify(f mtdabi.Flash, image io.Reader, opts Options) (*Report, error) {
+	r := &Report{First: -1}
+	before, statsErr := f.ECCStats()
+	compareOOB := opts.OOB && len(opts.OOBFree) > 0
+	page := pageSize(f.Info())
+	oob := make([]byte, f.Info().Oobsize)
+	err := walk(f, image, opts, func(offset int64) {
+		r.BadBlocks = append(r.BadBlocks, offset)
+	}, func(c *chunk) error {
+		// Read whole pages, to tell whether they are erased
+		data := make([]byte, mtdabi.RoundUp(int64(len(c.data)), page))
+		_, err := f.ReadAt(data, c.offset)
+		if err != nil && err != unix.EUCLEAN && err != unix.EBADMSG {
+			return fmt.Errorf("reading 0x%x: %w", c.offset, err)
+		}
+		for i := 0; int64(i)*page < int64(len(c.data)); i++ {
+			start := int64(i) * page
+			end := start + page
+			want := c.data[start:min(end, int64(len(c.data)))]
+			got := data[start:end]
+			d := PageDiff{
+				Offset:         c.offset + start,
+				ImageOffset:    c.imageOffset + start,
+				Bitflips:       bitDiff(got[:len(want)], want),
+				ErasedBitflips: bitDiff(got, nil),
+				Erased:         mtdabi.IsErased(got),
+				ImageErased:    mtdabi.IsErased(want),
+			}
+			if c.oob != nil {
+				d.ImageOffset += int64(i) * int64(len(oob))
+				d.ImageErased = d.ImageErased && mtdabi.IsErased(c.oob[i])
+			}
+			if compareOOB {
+				err = f.ReadOOB(d.Offset, oob)
+				if err != nil {
+					return fmt.Errorf("reading OOB of 0x%x: %w", d.Offset, err)
+				}
+				d.Erased = d.Erased && mtdabi.IsErased(oob)
+				for _, free := range opts.OOBFree {
+					if free.Offset+free.Length > uint32(len(oob)) {
+						return fmt.Errorf("OOB free bytes %v-%v out of the OOB area of %v bytes",
+							free.Offset, free.Offset+free.Length, len(oob))
+					}
+					d.OOBBitflips += bitDiff(oob[free.Offset:free.Offset+free.Length],
+						c.oob[i][free.Offset:free.Offset+free.Length])
+				}
+			}
+
+			r.Pages++
+			if d.Erased {
+				r.ErasedPages++
+			} else {
+				r.ProgrammedPages++
+			}
+			if d.Bitflips == 0 && d.OOBBitflips == 0 {
+				continue
+			}
+			r.Diffs = append(r.Diffs, d)
+			if r.First < 0 {
+				r.First = d.Offset
+				for j := range want {
+					if got[j] != want[j] {
+						r.First += int64(j)
+						break
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	after, err := f.ECCStats()
+	if statsErr == nil && err == nil {
+		r.Corrected = after.Corrected - before.Corrected
+		r.Failed = after.Failed - before.Failed
+	}
+	return r, nil
+}
+
+// bitDiff returns the number of bits differing between a and b, or between a
+// and erased bytes if b is nil.
+func bitDiff(a, b []byte) int {
+	n := 0
+	for i, v := range a {
+		w := byte(0xff)
+		if b != nil {
+			w = b[i]
+		}
+		n += bits.OnesCount8(v ^ w)
+	}
+	return n
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
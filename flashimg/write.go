@@ -0,0 +1,110 @@
+package flashimg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// pageWriter is implemented by flashes programming the data and OOB area of
+// pages together, such as *mtdabi.Device and *mtdsim.Sim.
+type pageWriter interface {
+	Write(offset int64, data, oob []byte, mode uint8) error
+}
+
+// WriteStats counts what Write did.
+type WriteStats struct {
+	// ErasedBlocks is the number of eraseblocks erased.
+	ErasedBlocks int
+	// BadBlocks lists the offsets of the bad eraseblocks skipped.
+	BadBlocks []int64
+	// WrittenPages and SkippedPages count the pages of the image programmed,
+	// and those left erased because all their bytes, OOB included, are.
+	WrittenPages, SkippedPages int
+}
+
+// Write erases the eraseblocks image goes to, laid out as described by opts,
+// and programs the pages of image that are not empty. Programming empty pages
+// would only waste time, and a page programmed with 0xff bytes is no longer
+// seen as empty by UBI and its fastmap. The rest of the last eraseblock is
+// left erased, and the last page is padded with 0xff bytes.
+//
+// opts.Offset must be aligned to eraseblocks. Images holding OOB areas are
+// programmed with MTD_OPS_PLACE_OOB, which needs a flash implementing Write
+// as mtdabi.Device does.
+func Write(f mtdabi.Flash, image io.Reader, opts Options) (*WriteStats, error) {
+	block, err := f.Geometry().BlockAt(opts.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if block.Offset != opts.Offset {
+		return nil, fmt.Errorf("image offset 0x%x %w to eraseblock at 0x%x", opts.Offset, mtdabi.ErrUnaligned, block.Offset)
+	}
+	pw, ok := f.(pageWriter)
+	if opts.OOB && !ok {
+		return nil, errors.New("flash cannot program OOB areas with data")
+	}
+	page := pageSize(f.Info())
+	s := &WriteStats{}
+	err = walk(f, image, opts, func(offset int64) {
+		s.BadBlocks = append(s.BadBlocks, offset)
+	}, func(c *chunk) error {
+		b, err := f.Geometry().BlockAt(c.offset)
+		if err != nil {
+			return err
+		}
+		err = f.Erase(b.Offset, b.Size)
+		if err != nil {
+			return fmt.Errorf("erasing 0x%x: %w", b.Offset, err)
+		}
+		s.ErasedBlocks++
+
+		data := c.data
+		if pad := mtdabi.RoundUp(int64(len(data)), page) - int64(len(data)); pad > 0 {
+			data = append(data, bytes.Repeat([]byte{0xff}, int(pad))...)
+		}
+		// Runs of pages with data are programmed at once, unless OOB areas
+		// are programmed with each page
+		run := int64(0)
+		flush := func(end int64) error {
+			if run == end {
+				return nil
+			}
+			_, err := f.WriteAt(data[run:end], c.offset+run)
+			if err != nil {
+				return fmt.Errorf("writing 0x%x: %w", c.offset+run, err)
+			}
+			return nil
+		}
+		for i := int64(0); i*page < int64(len(data)); i++ {
+			start := i * page
+			p := data[start : start+page]
+			if mtdabi.IsErased(p) && (c.oob == nil || mtdabi.IsErased(c.oob[i])) {
+				s.SkippedPages++
+				err = flush(start)
+				if err != nil {
+					return err
+				}
+				run = start + page
+				continue
+			}
+			s.WrittenPages++
+			if c.oob != nil {
+				err = pw.Write(c.offset+start, p, c.oob[i], unix.MTD_OPS_PLACE_OOB)
+				if err != nil {
+					return fmt.Errorf("writing 0x%x: %w", c.offset+start, err)
+				}
+				run = start + page
+			}
+		}
+		return flush(int64(len(data)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
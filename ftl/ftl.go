@@ -0,0 +1,386 @@
+// Package ftl is a minimal flash translation layer for small configuration
+// partitions on raw flash: a log-structured key/value store built on
+// mtdabi.Flash.
+//
+// Every update appends a CRC-protected record, padded to whole pages, to the
+// current eraseblock; the record with the highest sequence number wins.
+// Writes interrupted by a power cut leave a record failing its CRC, which is
+// ignored, so the previous value survives. Garbage collection erases
+// eraseblocks holding only stale records; when none is left, the live records
+// of the eraseblock with the most stale data are copied to a block kept in
+// reserve before it is erased. Bad eraseblocks are skipped, and eraseblocks
+// failing to erase are marked bad.
+//
+// The latest value of every key is kept in memory.
+package ftl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// Errors of KV, to be tested with errors.Is.
+var (
+	// ErrNotFound means the key does not exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrTooLarge means a record does not fit in an eraseblock.
+	ErrTooLarge = errors.New("record larger than an eraseblock")
+	// ErrFull means garbage collection cannot free enough space.
+	ErrFull = errors.New("no space left")
+)
+
+// KV is a key/value store on a flash partition. It is safe for concurrent
+// use. After an error other than ErrNotFound, ErrTooLarge and ErrFull, the
+// in-memory state may no longer match the flash, and the store should be
+// opened again.
+type KV struct {
+	mu       sync.Mutex
+	flash    mtdabi.Flash
+	pageSize int64
+	blocks   []*block
+	index    map[string]*entry
+	// keyBlocks counts the eraseblocks holding records of each key
+	keyBlocks map[string]int
+	seq       uint64
+	head      *block
+}
+
+// block is an eraseblock of the store.
+type block struct {
+	offset, size int64
+	bad          bool
+	// used is the number of bytes written from the start
+	used int64
+	// full blocks take no more records until erased
+	full bool
+	// liveBytes is the size of the records of the index held by the block
+	liveBytes int64
+	maxSeq    uint64
+	// keys counts the records of each key held by the block
+	keys map[string]int
+}
+
+// entry is the latest record of a key.
+type entry struct {
+	block  *block
+	seq    uint64
+	size   int64
+	delete bool
+	value  []byte
+}
+
+// Open scans the eraseblocks of f and returns the store they hold. An erased
+// flash holds an empty store.
+func Open(f mtdabi.Flash) (*KV, error) {
+	blocks, err := f.Geometry().Blocks(0, f.Geometry().Size)
+	if err != nil {
+		return nil, err
+	}
+	kv := &KV{
+		flash:     f,
+		pageSize:  int64(f.Info().Writesize),
+		index:     make(map[string]*entry),
+		keyBlocks: make(map[string]int),
+	}
+	for _, b := range blocks {
+		blk := &block{offset: b.Offset, size: b.Size, keys: make(map[string]int)}
+		kv.blocks = append(kv.blocks, blk)
+		blk.bad, err = f.IsBad(b.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("ftl: checking eraseblock at 0x%x: %w", b.Offset, err)
+		}
+		if blk.bad {
+			continue
+		}
+		err = kv.scan(blk)
+		if err != nil {
+			return nil, fmt.Errorf("ftl: reading eraseblock at 0x%x: %w", b.Offset, err)
+		}
+	}
+	// Only the partially written block holding the newest record takes more
+	// records
+	for _, blk := range kv.blocks {
+		if blk.bad || blk.full || blk.used == 0 {
+			continue
+		}
+		if kv.head == nil || blk.maxSeq > kv.head.maxSeq {
+			if kv.head != nil {
+				kv.head.full = true
+			}
+			kv.head = blk
+		} else {
+			blk.full = true
+		}
+	}
+	return kv, nil
+}
+
+// scan reads the records of blk. A block is appended to after its last
+// record only if the rest of it is erased.
+func (kv *KV) scan(blk *block) error {
+	buf := make([]byte, blk.size)
+	_, err := kv.flash.ReadAt(buf, blk.offset)
+	// Corrected or not, the data is returned, and records carry a CRC
+	if err != nil && err != unix.EUCLEAN && err != unix.EBADMSG {
+		return err
+	}
+	pos := int64(0)
+	for pos < blk.size {
+		if mtdabi.IsErased(buf[pos : pos+kv.pageSize]) {
+			if !mtdabi.IsErased(buf[pos:]) {
+				// Interrupted erase
+				break
+			}
+			blk.used = pos
+			return nil
+		}
+		r, err := unmarshalRecord(buf[pos:])
+		if err != nil {
+			// Interrupted write: the rest of the block cannot be programmed
+			break
+		}
+		kv.add(blk, r)
+		pos += mtdabi.RoundUp(r.size(), kv.pageSize)
+	}
+	blk.used = blk.size
+	blk.full = true
+	return nil
+}
+
+// add indexes record r held by blk.
+func (kv *KV) add(blk *block, r *record) {
+	blk.keys[r.key]++
+	if blk.keys[r.key] == 1 {
+		kv.keyBlocks[r.key]++
+	}
+	if r.seq >= kv.seq {
+		kv.seq = r.seq + 1
+	}
+	if r.seq > blk.maxSeq {
+		blk.maxSeq = r.seq
+	}
+	e := kv.index[r.key]
+	if e != nil {
+		if e.seq > r.seq {
+			return
+		}
+		e.block.liveBytes -= e.size
+	}
+	size := mtdabi.RoundUp(r.size(), kv.pageSize)
+	kv.index[r.key] = &entry{block: blk, seq: r.seq, size: size, delete: r.delete, value: r.value}
+	blk.liveBytes += size
+}
+
+// Get returns the value of key.
+func (kv *KV) Get(key string) ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	e := kv.index[key]
+	if e == nil || e.delete {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, key)
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+// Keys returns the keys of the store in increasing order.
+func (kv *KV) Keys() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	keys := make([]string, 0, len(kv.index))
+	for key, e := range kv.index {
+		if !e.delete {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put sets the value of key. When Put returns, the value is on the flash.
+func (kv *KV) Put(key string, value []byte) error {
+	if key == "" || len(key) > MaxKeyLen {
+		return fmt.Errorf("ftl: invalid key length %v", len(key))
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.append(&record{key: key, value: value}, false)
+}
+
+// Delete removes key, if it exists.
+func (kv *KV) Delete(key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	e := kv.index[key]
+	if e == nil || e.delete {
+		return nil
+	}
+	return kv.append(&record{key: key, delete: true}, false)
+}
+
+// append writes r with the next sequence number. During garbage collection,
+// the block kept in reserve may be used.
+func (kv *KV) append(r *record, gc bool) error {
+	size := mtdabi.RoundUp(r.size(), kv.pageSize)
+	if size > kv.blocks[0].size {
+		return fmt.Errorf("ftl: %w: %v bytes", ErrTooLarge, size)
+	}
+	for range kv.blocks {
+		blk, err := kv.space(size, gc)
+		if err != nil {
+			return err
+		}
+		r.seq = kv.seq
+		_, err = kv.flash.WriteAt(r.marshal(kv.pageSize), blk.offset+blk.used)
+		if err != nil {
+			// The rest of a block is never programmed after a failed
+			// write; retry in another block if the page failed
+			blk.full = true
+			blk.used = blk.size
+			if err == unix.EIO {
+				continue
+			}
+			return err
+		}
+		blk.used += size
+		kv.add(blk, r)
+		return nil
+	}
+	return fmt.Errorf("ftl: %w: writes keep failing", ErrFull)
+}
+
+// space returns a block with size bytes free, collecting garbage if needed.
+// Outside garbage collection, an erased block is kept in reserve.
+func (kv *KV) space(size int64, gc bool) (*block, error) {
+	reserve := 1
+	if gc {
+		reserve = 0
+	}
+	for tries := 0; tries <= 2*len(kv.blocks); tries++ {
+		if kv.head != nil && !kv.head.full && kv.head.used+size <= kv.head.size {
+			return kv.head, nil
+		}
+		if kv.head != nil {
+			kv.head.full = true
+			kv.head = nil
+		}
+		free := kv.freeBlocks()
+		if len(free) > reserve {
+			kv.head = free[0]
+			return kv.head, nil
+		}
+		if gc {
+			break
+		}
+		progress, err := kv.collect()
+		if err != nil {
+			return nil, err
+		}
+		if !progress {
+			break
+		}
+	}
+	return nil, fmt.Errorf("ftl: %w", ErrFull)
+}
+
+// freeBlocks returns the erased blocks.
+func (kv *KV) freeBlocks() []*block {
+	var free []*block
+	for _, blk := range kv.blocks {
+		if !blk.bad && !blk.full && blk.used == 0 {
+			free = append(free, blk)
+		}
+	}
+	return free
+}
+
+// collect erases the full blocks holding no live records. If there are none,
+// it copies the live records of the full block with the most stale data to
+// the block kept in reserve, and erases it. It reports whether space was
+// freed.
+func (kv *KV) collect() (bool, error) {
+	progress := false
+	var victim *block
+	for _, blk := range kv.blocks {
+		if blk.bad || !blk.full || blk == kv.head {
+			continue
+		}
+		if blk.liveBytes == 0 {
+			err := kv.erase(blk)
+			if err != nil {
+				return false, err
+			}
+			progress = true
+			continue
+		}
+		if victim == nil || blk.used-blk.liveBytes > victim.used-victim.liveBytes {
+			victim = blk
+		}
+	}
+	if progress || victim == nil || victim.used == victim.liveBytes {
+		return progress, nil
+	}
+
+	var moved []string
+	for key, e := range kv.index {
+		if e.block == victim {
+			moved = append(moved, key)
+		}
+	}
+	sort.Strings(moved)
+	for _, key := range moved {
+		e := kv.index[key]
+		if e.delete && kv.keyBlocks[key] == 1 {
+			// No older record is left to hide
+			kv.forget(key)
+			continue
+		}
+		err := kv.append(&record{key: key, delete: e.delete, value: e.value}, true)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, kv.erase(victim)
+}
+
+// erase erases blk, marking it bad if the erase fails.
+func (kv *KV) erase(blk *block) error {
+	err := kv.flash.Erase(blk.offset, blk.size)
+	if err == unix.EIO {
+		err = kv.flash.MarkBad(blk.offset)
+		if err != nil {
+			return err
+		}
+		blk.bad = true
+	} else if err != nil {
+		return err
+	}
+	for key := range blk.keys {
+		kv.keyBlocks[key]--
+		if kv.keyBlocks[key] == 0 {
+			delete(kv.keyBlocks, key)
+		}
+		e := kv.index[key]
+		if e != nil && e.delete && kv.keyBlocks[key] == 1 {
+			kv.forget(key)
+		}
+	}
+	blk.keys = make(map[string]int)
+	blk.used = 0
+	blk.full = false
+	blk.liveBytes = 0
+	blk.maxSeq = 0
+	return nil
+}
+
+// forget drops the tombstone of key from the index, once no block holds an
+// older record of key.
+func (kv *KV) forget(key string) {
+	e := kv.index[key]
+	e.block.liveBytes -= e.size
+	delete(kv.index, key)
+}
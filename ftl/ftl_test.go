@@ -0,0 +1,188 @@
+package ftl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+)
+
+func open(t *testing.T, f mtdabi.Flash) *KV {
+	kv, err := Open(f)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return kv
+}
+
+func put(t *testing.T, kv *KV, key, value string) {
+	err := kv.Put(key, []byte(value))
+	if err != nil {
+		t.Fatalf("Put '%v' failed: %v", key, err)
+	}
+}
+
+func checkGet(t *testing.T, kv *KV, key, want string) {
+	value, err := kv.Get(key)
+	if err != nil {
+		t.Fatalf("Get '%v' failed: %v", key, err)
+	}
+	if string(value) != want {
+		t.Errorf("Get '%v': want '%v' got '%v'", key, want, value)
+	}
+}
+
+func TestKV(t *testing.T) {
+	sim := mtdsim.NewSmallNAND()
+	kv := open(t, sim)
+	if keys := kv.Keys(); len(keys) != 0 {
+		t.Errorf("Erased flash holds keys %v", keys)
+	}
+	put(t, kv, "hostname", "router")
+	put(t, kv, "ip", "192.0.2.1")
+	put(t, kv, "gone", "soon")
+	err := kv.Delete("gone")
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_, err = kv.Get("gone")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get deleted key: want '%v' got '%v'", ErrNotFound, err)
+	}
+
+	// Many more updates than pages, so garbage is collected
+	for i := 0; i < 500; i++ {
+		put(t, kv, "counter", strconv.Itoa(i))
+	}
+	checkGet(t, kv, "counter", "499")
+
+	kv = open(t, sim)
+	want := []string{"counter", "hostname", "ip"}
+	if keys := kv.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys: want '%v' got '%v'", want, keys)
+	}
+	checkGet(t, kv, "hostname", "router")
+	checkGet(t, kv, "counter", "499")
+	_, err = kv.Get("gone")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get deleted key after reopening: want '%v' got '%v'", ErrNotFound, err)
+	}
+
+	err = kv.Put("big", make([]byte, mtdsim.SmallNAND.Erasesize))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Put too large: want '%v' got '%v'", ErrTooLarge, err)
+	}
+	// Two blocks of live data do not fit with the reserve block
+	value := make([]byte, 3*mtdsim.SmallNAND.Writesize)
+	for i := 0; ; i++ {
+		err = kv.Put(fmt.Sprintf("key%d", i), value)
+		if errors.Is(err, ErrFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i > 32 {
+			t.Fatalf("Put beyond capacity succeeded")
+		}
+	}
+	checkGet(t, kv, "counter", "499")
+}
+
+func TestKVBadBlocks(t *testing.T) {
+	erasesize := int64(mtdsim.SmallNAND.Erasesize)
+	sim := mtdsim.NewSmallNAND(erasesize)
+	kv := open(t, sim)
+	// Programming fails in the first block and erasing in the third
+	err := sim.Inject(mtdsim.Fault{Kind: mtdsim.FaultProgram, Offset: 0, Count: 1})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	err = sim.Inject(mtdsim.Fault{Kind: mtdsim.FaultErase, Offset: 2 * erasesize})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		put(t, kv, "counter", strconv.Itoa(i))
+	}
+	put(t, kv, "name", "value")
+
+	for _, offset := range []int64{erasesize, 2 * erasesize} {
+		bad, err := sim.IsBad(offset)
+		if err != nil {
+			t.Fatalf("IsBad failed: %v", err)
+		}
+		if !bad {
+			t.Errorf("Block at 0x%x not bad", offset)
+		}
+	}
+	kv = open(t, sim)
+	checkGet(t, kv, "counter", "199")
+	checkGet(t, kv, "name", "value")
+}
+
+func TestKVPowerLoss(t *testing.T) {
+	base := mtdsim.NewSmallNAND()
+	kv := open(t, base)
+	put(t, kv, "stable", "value")
+	put(t, kv, "gone", "soon")
+	err := kv.Delete("gone")
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	// Fill most of the space, so the workload collects garbage
+	for i := 0; i < 80; i++ {
+		put(t, kv, "counter", strconv.Itoa(i))
+	}
+
+	const updates = 30
+	workload := func(f mtdabi.Flash) error {
+		kv, err := Open(f)
+		if err != nil {
+			return err
+		}
+		for i := 80; i < 80+updates; i++ {
+			err = kv.Put("counter", []byte(strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	check := func(f mtdabi.Flash) error {
+		kv, err := Open(f)
+		if err != nil {
+			return err
+		}
+		value, err := kv.Get("stable")
+		if err != nil || !bytes.Equal(value, []byte("value")) {
+			return fmt.Errorf("stable key lost: %q, %v", value, err)
+		}
+		value, err = kv.Get("counter")
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(string(value))
+		if err != nil || n < 79 || n >= 80+updates {
+			return fmt.Errorf("unexpected counter %q", value)
+		}
+		_, err = kv.Get("gone")
+		if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("deleted key: %v", err)
+		}
+		// The store remains writable
+		return kv.Put("counter", []byte("0"))
+	}
+	failures, err := mtdsim.CheckPowerLoss(base, workload, check, true)
+	if err != nil {
+		t.Fatalf("CheckPowerLoss failed: %v", err)
+	}
+	for _, f := range failures {
+		t.Errorf("Power loss: %v", f)
+	}
+}
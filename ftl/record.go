@@ -0,0 +1,86 @@
+package ftl
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// Record layout, big-endian. Records start on a page boundary and are padded
+// to whole pages with erased bytes.
+const (
+	// recordMagic starts every record ("FKV1")
+	recordMagic = 0x464b5631
+	// headerSize is the size of the record header: magic, sequence number,
+	// flags, reserved byte, key length, value length and CRC
+	headerSize = 24
+
+	// flagDelete marks a record deleting its key
+	flagDelete = 0x01
+
+	// MaxKeyLen is the maximum length of a key.
+	MaxKeyLen = 0xffff
+)
+
+// errNoRecord means the bytes do not hold a valid record.
+var errNoRecord = errors.New("no valid record")
+
+// record is a record of the log.
+type record struct {
+	seq    uint64
+	delete bool
+	key    string
+	value  []byte
+}
+
+// size returns the number of bytes of the encoded record.
+func (r *record) size() int64 {
+	return int64(headerSize + len(r.key) + len(r.value))
+}
+
+// marshal encodes r, padded with erased bytes to a multiple of pageSize.
+func (r *record) marshal(pageSize int64) []byte {
+	buf := make([]byte, mtdabi.RoundUp(r.size(), pageSize))
+	binary.BigEndian.PutUint32(buf[0:], recordMagic)
+	binary.BigEndian.PutUint64(buf[4:], r.seq)
+	if r.delete {
+		buf[12] = flagDelete
+	}
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(r.key)))
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(r.value)))
+	n := headerSize + copy(buf[headerSize:], r.key)
+	n += copy(buf[n:], r.value)
+	crc := crc32.ChecksumIEEE(buf[:20])
+	crc = crc32.Update(crc, crc32.IEEETable, buf[headerSize:n])
+	binary.BigEndian.PutUint32(buf[20:], crc)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0xff
+	}
+	return buf
+}
+
+// unmarshalRecord decodes the record at the start of buf, checking its CRC.
+func unmarshalRecord(buf []byte) (*record, error) {
+	if len(buf) < headerSize || binary.BigEndian.Uint32(buf) != recordMagic {
+		return nil, errNoRecord
+	}
+	keyLen := int(binary.BigEndian.Uint16(buf[14:]))
+	valueLen := int64(binary.BigEndian.Uint32(buf[16:]))
+	end := int64(headerSize+keyLen) + valueLen
+	if end > int64(len(buf)) {
+		return nil, errNoRecord
+	}
+	crc := crc32.ChecksumIEEE(buf[:20])
+	crc = crc32.Update(crc, crc32.IEEETable, buf[headerSize:end])
+	if crc != binary.BigEndian.Uint32(buf[20:]) {
+		return nil, errNoRecord
+	}
+	return &record{
+		seq:    binary.BigEndian.Uint64(buf[4:]),
+		delete: buf[12]&flagDelete != 0,
+		key:    string(buf[headerSize : headerSize+keyLen]),
+		value:  append([]byte(nil), buf[headerSize+keyLen:end]...),
+	}, nil
+}
@@ -0,0 +1,182 @@
+package mtdabi
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// Block is an eraseblock of an MTD.
+type Block struct {
+	Offset int64
+	Size   int64
+}
+
+// End returns the offset just past the end of the eraseblock.
+func (b Block) End() int64 {
+	return b.Offset + b.Size
+}
+
+// Geometry describes the eraseblock layout of an MTD. On devices with erase
+// regions (MEMGETREGIONCOUNT > 0, e.g., boot-sector NOR flash), the erase size
+// varies by address and unix.MtdInfo.Erasesize is only the largest one; the
+// Geometry answers block queries correctly for both kinds of devices.
+type Geometry struct {
+	// Size is the total size of the MTD in bytes.
+	Size int64
+	// Regions are the erase regions of the MTD, sorted by offset and covering
+	// the whole device. Devices without erase regions are described by a
+	// single region of unix.MtdInfo.Erasesize blocks.
+	Regions []unix.RegionInfo
+}
+
+// NewGeometry builds a Geometry from the MTD characteristics and the erase
+// regions as returned by MEMGETREGIONINFO. If regions is empty the device is
+// taken to have a uniform erase size of info.Erasesize, which must divide its
+// size.
+func NewGeometry(info unix.MtdInfo, regions []unix.RegionInfo) (*Geometry, error) {
+	g := &Geometry{Size: int64(info.Size)}
+	if len(regions) == 0 {
+		if info.Erasesize == 0 {
+			return nil, fmt.Errorf("geometry: erase size is 0")
+		}
+		if info.Size%info.Erasesize != 0 {
+			return nil, fmt.Errorf("geometry: MTD size 0x%x is not a multiple of erase size 0x%x", info.Size, info.Erasesize)
+		}
+		g.Regions = []unix.RegionInfo{{
+			Offset:    0,
+			Erasesize: info.Erasesize,
+			Numblocks: info.Size / info.Erasesize,
+		}}
+		return g, nil
+	}
+	g.Regions = append([]unix.RegionInfo(nil), regions...)
+	sort.Slice(g.Regions, func(i, j int) bool {
+		return g.Regions[i].Offset < g.Regions[j].Offset
+	})
+	next := int64(0)
+	for _, r := range g.Regions {
+		if r.Erasesize == 0 {
+			return nil, fmt.Errorf("geometry: region %v has erase size 0", r.Regionindex)
+		}
+		if int64(r.Offset) != next {
+			return nil, fmt.Errorf("geometry: region %v starts at 0x%x, want 0x%x",
+				r.Regionindex, r.Offset, next)
+		}
+		next = regionEnd(r)
+	}
+	if next != g.Size {
+		return nil, fmt.Errorf("geometry: regions end at 0x%x, want MTD size 0x%x", next, g.Size)
+	}
+	return g, nil
+}
+
+// GetGeometry reads the MTD characteristics and all erase regions of the
+// device pointed by fd using MEMGETINFO, MEMGETREGIONCOUNT and
+// MEMGETREGIONINFO.
+func GetGeometry(fd uintptr) (*Geometry, error) {
+	var info unix.MtdInfo
+	err := MemGetInfo(fd, &info)
+	if err != nil {
+		return nil, fmt.Errorf("MemGetInfo failed: %w", err)
+	}
+	return getGeometry(fd, info)
+}
+
+// getGeometry is GetGeometry for an already known info.
+func getGeometry(fd uintptr, info unix.MtdInfo) (*Geometry, error) {
+	var count int32
+	err := MemGetRegionCount(fd, &count)
+	if err != nil {
+		return nil, fmt.Errorf("MemGetRegionCount failed: %w", err)
+	}
+	regions := make([]unix.RegionInfo, count)
+	for i := range regions {
+		regions[i].Regionindex = uint32(i)
+		err = MemGetRegionInfo(fd, &regions[i])
+		if err != nil {
+			return nil, fmt.Errorf("MemGetRegionInfo failed for region %v: %w", i, err)
+		}
+	}
+	return NewGeometry(info, regions)
+}
+
+// BlockAt returns the eraseblock containing offset.
+func (g *Geometry) BlockAt(offset int64) (Block, error) {
+	if offset < 0 || offset >= g.Size {
+		return Block{}, fmt.Errorf("offset 0x%x %w of MTD size 0x%x", offset, ErrOutOfBounds, g.Size)
+	}
+	i := sort.Search(len(g.Regions), func(i int) bool {
+		return regionEnd(g.Regions[i]) > offset
+	})
+	if i == len(g.Regions) {
+		return Block{}, fmt.Errorf("offset 0x%x is not in any erase region", offset)
+	}
+	r := g.Regions[i]
+	size := int64(r.Erasesize)
+	return Block{
+		Offset: int64(r.Offset) + (offset-int64(r.Offset))/size*size,
+		Size:   size,
+	}, nil
+}
+
+// NextBoundary returns the first eraseblock boundary after offset, which is
+// the end of the eraseblock containing offset.
+func (g *Geometry) NextBoundary(offset int64) (int64, error) {
+	b, err := g.BlockAt(offset)
+	if err != nil {
+		return 0, err
+	}
+	return b.End(), nil
+}
+
+// Blocks returns the eraseblocks overlapping the region of length bytes at
+// start, in order and across erase regions.
+func (g *Geometry) Blocks(start, length int64) ([]Block, error) {
+	if length <= 0 {
+		return nil, nil
+	}
+	err := checkBounds(g.Size, "range", start, length)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []Block
+	for offset := start; offset < start+length; {
+		b, err := g.BlockAt(offset)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+		offset = b.End()
+	}
+	return blocks, nil
+}
+
+// CheckErase is like the package-level CheckErase, but checks the alignment
+// against the eraseblocks of the erase regions the region falls in.
+func (g *Geometry) CheckErase(start, length int64) error {
+	if length <= 0 {
+		return fmt.Errorf("erase at 0x%x: length %v %w", start, length, ErrOutOfBounds)
+	}
+	err := checkBounds(g.Size, "erase", start, length)
+	if err != nil {
+		return err
+	}
+	b, _ := g.BlockAt(start)
+	if b.Offset != start {
+		return fmt.Errorf("erase start 0x%x %w to eraseblock at 0x%x of size 0x%x",
+			start, ErrUnaligned, b.Offset, b.Size)
+	}
+	b, _ = g.BlockAt(start + length - 1)
+	if b.End() != start+length {
+		return fmt.Errorf("erase end 0x%x %w to eraseblock at 0x%x of size 0x%x",
+			start+length, ErrUnaligned, b.Offset, b.Size)
+	}
+	return nil
+}
+
+// regionEnd returns the offset just past the end of the erase region r.
+func regionEnd(r unix.RegionInfo) int64 {
+	return int64(r.Offset) + int64(r.Erasesize)*int64(r.Numblocks)
+}
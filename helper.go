@@ -7,9 +7,32 @@ import (
 // ioctl performs an ioctl operation specified by req and sets & gets the value
 // on the device pointed by fd.
 func ioctl(fd, req, value uintptr) error {
-	_, _, err := unix.Syscall(unix.SYS_IOCTL, fd, req, value)
+	_, err := ioctlRet(fd, req, value)
+	return err
+}
+
+// ioctlRet is like ioctl, but also returns the non-negative return value of the
+// ioctl call, which some requests (e.g., MEMISLOCKED) use as their result.
+func ioctlRet(fd, req, value uintptr) (int, error) {
+	r, _, err := unix.Syscall(unix.SYS_IOCTL, fd, req, value)
 	if err != 0 {
-		return err
+		return 0, err
 	}
-	return nil
+	return int(r), nil
+}
+
+// IsErased reports whether all bytes of buf read as erased flash.
+func IsErased(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// RoundUp rounds length up to a multiple of unit, such as a page or an
+// eraseblock.
+func RoundUp(length, unit int64) int64 {
+	return (length + unit - 1) / unit * unit
 }
@@ -0,0 +1,76 @@
+package jffs2
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// decompress decompresses the data of an inode node to size bytes.
+func decompress(compr uint8, data []byte, size int) ([]byte, error) {
+	switch compr {
+	case ComprNone:
+		if len(data) < size {
+			return nil, fmt.Errorf("uncompressed data of %v bytes, want %v", len(data), size)
+		}
+		return data[:size], nil
+	case ComprZero:
+		return make([]byte, size), nil
+	case ComprRtime:
+		return rtimeDecompress(data, size)
+	case ComprZlib:
+		return zlibDecompress(data, size)
+	}
+	return nil, fmt.Errorf("unsupported compression 0x%02x", compr)
+}
+
+// zlibDecompress inflates data to size bytes. Like the kernel, it accepts
+// streams with and without zlib header.
+func zlibDecompress(data []byte, size int) ([]byte, error) {
+	var r io.Reader
+	if len(data) >= 2 && data[0]&0x0f == 8 && (uint(data[0])<<8|uint(data[1]))%31 == 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("zlib: %w", err)
+		}
+		r = zr
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	out := make([]byte, size)
+	_, err := io.ReadFull(r, out)
+	if err != nil {
+		return nil, fmt.Errorf("zlib: %w", err)
+	}
+	return out, nil
+}
+
+// rtimeDecompress decodes the run-length encoding of JFFS2_COMPR_RTIME: each
+// literal byte is followed by the number of bytes to repeat from after the
+// previous occurrence of that byte.
+func rtimeDecompress(data []byte, size int) ([]byte, error) {
+	var positions [256]int
+	out := make([]byte, 0, size)
+	pos := 0
+	for len(out) < size {
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("rtime: data truncated")
+		}
+		value := data[pos]
+		repeat := int(data[pos+1])
+		pos += 2
+		out = append(out, value)
+		backoffs := positions[value]
+		positions[value] = len(out)
+		if len(out)+repeat > size {
+			return nil, fmt.Errorf("rtime: data longer than %v bytes", size)
+		}
+		for ; repeat > 0; repeat-- {
+			out = append(out, out[backoffs])
+			backoffs++
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,293 @@
+package jffs2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rootIno is the inode number of the root directory.
+const rootIno = 1
+
+// File types of inode modes (S_IFMT)
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+)
+
+// FS is the file system reconstructed from a JFFS2 image. It implements
+// fs.FS; opening a symbolic link returns the link itself, whose contents are
+// the link target.
+type FS struct {
+	// Scan holds the nodes the file system was reconstructed from, and the
+	// nodes skipped because they are invalid.
+	Scan *Scan
+	// Errors are the inconsistencies found while reconstructing the tree,
+	// such as directory entries pointing to inodes without valid nodes.
+	Errors []error
+
+	inodes map[uint32]*inode
+}
+
+// inode is a reconstructed inode.
+type inode struct {
+	// meta is the inode node with the highest version.
+	meta     *Inode
+	data     []byte
+	children map[string]*inode
+}
+
+// Parse reads a JFFS2 image of size bytes from r and reconstructs its
+// directory tree. For every name and every range of file data, the node with
+// the highest version wins. File data is held in memory, so inode versions
+// extending a file beyond the size of the image, which only sparse files
+// can legitimately do, are skipped. Invalid nodes and inconsistencies are reported in
+// the returned FS; Parse itself only fails if r cannot be read or holds no
+// nodes at all.
+func Parse(r io.ReaderAt, size int64) (*FS, error) {
+	s, err := ScanImage(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if s.ByteOrder == nil {
+		return nil, fmt.Errorf("no JFFS2 nodes found")
+	}
+	return newFS(s), nil
+}
+
+// newFS reconstructs the file system from the nodes of s.
+func newFS(s *Scan) *FS {
+	fsys := &FS{Scan: s, inodes: make(map[uint32]*inode)}
+
+	nodes := make([]*Inode, len(s.Inodes))
+	copy(nodes, s.Inodes)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Version < nodes[j].Version
+	})
+	for _, n := range nodes {
+		size := int64(n.Offset) + int64(len(n.Data))
+		if int64(n.Isize) > size {
+			size = int64(n.Isize)
+		}
+		if size > s.size {
+			fsys.Errors = append(fsys.Errors, fmt.Errorf("inode %v version %v: size 0x%x larger than the image", n.Ino, n.Version, size))
+			continue
+		}
+		ino := fsys.inodes[n.Ino]
+		if ino == nil {
+			ino = &inode{}
+			fsys.inodes[n.Ino] = ino
+		}
+		ino.meta = n
+		if end := int(n.Offset) + len(n.Data); end > len(ino.data) {
+			ino.data = resize(ino.data, end)
+		}
+		copy(ino.data[n.Offset:], n.Data)
+		// The size of each version truncates the data written before
+		ino.data = resize(ino.data, int(n.Isize))
+	}
+	if fsys.inodes[rootIno] == nil {
+		fsys.inodes[rootIno] = &inode{meta: &Inode{Ino: rootIno, Mode: sIFDIR | 0755}}
+	}
+
+	type key struct {
+		pino uint32
+		name string
+	}
+	latest := make(map[key]*Dirent)
+	for _, d := range s.Dirents {
+		k := key{d.Pino, d.Name}
+		if prev := latest[k]; prev == nil || d.Version >= prev.Version {
+			latest[k] = d
+		}
+	}
+	dirents := make([]*Dirent, 0, len(latest))
+	for _, d := range latest {
+		dirents = append(dirents, d)
+	}
+	sort.Slice(dirents, func(i, j int) bool {
+		if dirents[i].Pino != dirents[j].Pino {
+			return dirents[i].Pino < dirents[j].Pino
+		}
+		return dirents[i].Name < dirents[j].Name
+	})
+	// Directories cannot be hard linked, which also rules out loops
+	linkedDirs := make(map[uint32]bool)
+	for _, d := range dirents {
+		if d.Ino == 0 {
+			continue
+		}
+		dir, child := fsys.inodes[d.Pino], fsys.inodes[d.Ino]
+		switch {
+		case dir == nil || !dir.isDir():
+			fsys.Errors = append(fsys.Errors, fmt.Errorf("entry %q: parent inode %v is not a directory", d.Name, d.Pino))
+		case child == nil:
+			fsys.Errors = append(fsys.Errors, fmt.Errorf("entry %q: inode %v has no valid nodes", d.Name, d.Ino))
+		case d.Ino == rootIno || !fs.ValidPath(d.Name) || strings.Contains(d.Name, "/"):
+			fsys.Errors = append(fsys.Errors, fmt.Errorf("entry %q in inode %v: invalid entry", d.Name, d.Pino))
+		case child.isDir() && linkedDirs[d.Ino]:
+			fsys.Errors = append(fsys.Errors, fmt.Errorf("entry %q: directory inode %v linked twice", d.Name, d.Ino))
+		default:
+			if child.isDir() {
+				linkedDirs[d.Ino] = true
+			}
+			if dir.children == nil {
+				dir.children = make(map[string]*inode)
+			}
+			dir.children[d.Name] = child
+		}
+	}
+	return fsys
+}
+
+// resize returns buf truncated or zero-extended to size bytes.
+func resize(buf []byte, size int) []byte {
+	if size <= len(buf) {
+		return buf[:size]
+	}
+	return append(buf, make([]byte, size-len(buf))...)
+}
+
+func (ino *inode) isDir() bool {
+	return ino.meta.Mode&sIFMT == sIFDIR
+}
+
+// Open opens the named file.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	ino := fsys.inodes[rootIno]
+	base := "."
+	if name != "." {
+		for _, elem := range strings.Split(name, "/") {
+			if !ino.isDir() {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			ino = ino.children[elem]
+			if ino == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			base = elem
+		}
+	}
+	info := &fileInfo{name: base, ino: ino}
+	if ino.isDir() {
+		return &dir{info: info}, nil
+	}
+	return &file{info: info, r: bytes.NewReader(ino.data)}, nil
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry. Sys returns the *Inode
+// holding the latest metadata.
+type fileInfo struct {
+	name string
+	ino  *inode
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return int64(len(fi.ino.data)) }
+func (fi *fileInfo) Mode() fs.FileMode          { return fileMode(fi.ino.meta.Mode) }
+func (fi *fileInfo) ModTime() time.Time         { return time.Unix(int64(fi.ino.meta.Mtime), 0) }
+func (fi *fileInfo) IsDir() bool                { return fi.ino.isDir() }
+func (fi *fileInfo) Sys() interface{}           { return fi.ino.meta }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// fileMode converts a Unix mode to an fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & sIFMT {
+	case sIFDIR:
+		m |= fs.ModeDir
+	case sIFLNK:
+		m |= fs.ModeSymlink
+	case sIFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case sIFBLK:
+		m |= fs.ModeDevice
+	case sIFIFO:
+		m |= fs.ModeNamedPipe
+	case sIFSOCK:
+		m |= fs.ModeSocket
+	}
+	if mode&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// file is an open non-directory file.
+type file struct {
+	info *fileInfo
+	r    *bytes.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *file) Close() error               { return nil }
+
+// ReadAt and Seek allow random access, like os.File.
+func (f *file) ReadAt(p []byte, off int64) (int, error) { return f.r.ReadAt(p, off) }
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+// dir is an open directory.
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir returns the entries of the directory sorted by name.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		names := make([]string, 0, len(d.info.ino.children))
+		for name := range d.info.ino.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d.entries = append(d.entries, &fileInfo{name: name, ino: d.info.ino.children[name]})
+		}
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,283 @@
+package jffs2
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+)
+
+// imageWriter appends nodes to an image, like mkfs.jffs2.
+type imageWriter struct {
+	bo  binary.ByteOrder
+	buf bytes.Buffer
+}
+
+// newNode returns a node of size bytes with its header filled in.
+func (w *imageWriter) newNode(nodetype uint16, size int) []byte {
+	n := make([]byte, size)
+	w.bo.PutUint16(n[0:], Magic)
+	w.bo.PutUint16(n[2:], nodetype)
+	w.bo.PutUint32(n[4:], uint32(size))
+	w.bo.PutUint32(n[8:], crc(n[:8]))
+	return n
+}
+
+// write appends n, padded to 4 bytes.
+func (w *imageWriter) write(n []byte) {
+	w.buf.Write(n)
+	for w.buf.Len()%4 != 0 {
+		w.buf.WriteByte(0xff)
+	}
+}
+
+func (w *imageWriter) dirent(pino, version, ino uint32, typ uint8, name string) {
+	n := w.newNode(NodetypeDirent, direntSize+len(name))
+	w.bo.PutUint32(n[12:], pino)
+	w.bo.PutUint32(n[16:], version)
+	w.bo.PutUint32(n[20:], ino)
+	n[28] = uint8(len(name))
+	n[29] = typ
+	copy(n[direntSize:], name)
+	w.bo.PutUint32(n[32:], crc(n[:direntSize-8]))
+	w.bo.PutUint32(n[36:], crc([]byte(name)))
+	w.write(n)
+}
+
+func (w *imageWriter) inode(ino, version, mode, isize, offset uint32, data []byte, compr uint8) {
+	cdata := data
+	switch compr {
+	case ComprZero:
+		cdata = nil
+	case ComprZlib:
+		var b bytes.Buffer
+		zw := zlib.NewWriter(&b)
+		zw.Write(data)
+		zw.Close()
+		cdata = b.Bytes()
+	}
+	n := w.newNode(NodetypeInode, inodeSize+len(cdata))
+	w.bo.PutUint32(n[12:], ino)
+	w.bo.PutUint32(n[16:], version)
+	w.bo.PutUint32(n[20:], mode)
+	w.bo.PutUint32(n[28:], isize)
+	w.bo.PutUint32(n[40:], 1600000000)
+	w.bo.PutUint32(n[44:], offset)
+	w.bo.PutUint32(n[48:], uint32(len(cdata)))
+	w.bo.PutUint32(n[52:], uint32(len(data)))
+	n[56] = compr
+	copy(n[inodeSize:], cdata)
+	w.bo.PutUint32(n[60:], crc(cdata))
+	w.bo.PutUint32(n[64:], crc(n[:inodeSize-8]))
+	w.write(n)
+}
+
+func buildImage(bo binary.ByteOrder) []byte {
+	w := &imageWriter{bo: bo}
+	w.write(w.newNode(NodetypeCleanmarker, unknownNodeSize))
+	w.inode(1, 1, sIFDIR|0755, 0, 0, nil, ComprNone)
+	w.inode(2, 1, sIFDIR|0755, 0, 0, nil, ComprNone)
+	w.dirent(1, 1, 2, 4, "etc")
+	w.inode(3, 1, sIFREG|0644, 11, 0, []byte("hello world"), ComprZlib)
+	w.dirent(2, 2, 3, 8, "motd")
+	// Overwritten, then extended with a hole
+	w.inode(3, 2, sIFREG|0600, 11, 6, []byte("jffs2"), ComprNone)
+	w.inode(3, 3, sIFREG|0600, 16, 11, make([]byte, 5), ComprZero)
+	w.inode(4, 1, sIFLNK|0777, 4, 0, []byte("motd"), ComprNone)
+	w.dirent(2, 3, 4, 10, "link")
+	// Unlinked
+	w.inode(5, 1, sIFREG|0644, 3, 0, []byte("old"), ComprNone)
+	w.dirent(1, 4, 5, 8, "gone")
+	w.dirent(1, 5, 0, 8, "gone")
+	// Erased space up to the end of the eraseblock
+	w.buf.Write(bytes.Repeat([]byte{0xff}, 64))
+	return w.buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		img := buildImage(bo)
+		fsys, err := Parse(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if fsys.Scan.ByteOrder != bo {
+			t.Errorf("byte order: want '%v' got '%v'", bo, fsys.Scan.ByteOrder)
+		}
+		if len(fsys.Scan.Errors) != 0 || len(fsys.Errors) != 0 {
+			t.Errorf("unexpected errors: %v %v", fsys.Scan.Errors, fsys.Errors)
+		}
+		if fsys.Scan.Cleanmarkers != 1 {
+			t.Errorf("cleanmarkers: want 1 got %v", fsys.Scan.Cleanmarkers)
+		}
+		err = fstest.TestFS(fsys, "etc/motd", "etc/link")
+		if err != nil {
+			t.Fatalf("TestFS failed: %v", err)
+		}
+		got, err := fs.ReadFile(fsys, "etc/motd")
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if want := "hello jffs2\x00\x00\x00\x00\x00"; string(got) != want {
+			t.Errorf("contents: want '%q' got '%q'", want, got)
+		}
+		info, err := fs.Stat(fsys, "etc/motd")
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Mode() != 0600 {
+			t.Errorf("mode: want '%v' got '%v'", fs.FileMode(0600), info.Mode())
+		}
+		info, err = fs.Stat(fsys, "etc/link")
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			t.Errorf("etc/link is not a symlink: %v", info.Mode())
+		}
+		_, err = fs.Stat(fsys, "gone")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("unlinked file: want ErrNotExist got '%v'", err)
+		}
+	}
+}
+
+func TestParseRtime(t *testing.T) {
+	// "abcabcabc" encoded as a, b, c with no repeats, then a repeating 5
+	// bytes from after the first a
+	data := []byte{'a', 0, 'b', 0, 'c', 0, 'a', 5}
+	got, err := rtimeDecompress(data, 9)
+	if err != nil {
+		t.Fatalf("rtimeDecompress failed: %v", err)
+	}
+	if string(got) != "abcabcabc" {
+		t.Errorf("want 'abcabcabc' got '%s'", got)
+	}
+}
+
+func TestParseBadCRC(t *testing.T) {
+	img := buildImage(binary.LittleEndian)
+	// Corrupt the data of the first version of etc/motd
+	i := bytes.Index(img, []byte("jffs2"))
+	img[i] ^= 0xff
+	fsys, err := Parse(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(fsys.Scan.Errors) != 1 || !errors.Is(fsys.Scan.Errors[0], ErrBadCRC) {
+		t.Fatalf("want one ErrBadCRC got %v", fsys.Scan.Errors)
+	}
+	f, err := fsys.Open("etc/motd")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if want := "hello world\x00\x00\x00\x00\x00"; string(got) != want {
+		t.Errorf("contents: want '%q' got '%q'", want, got)
+	}
+}
+
+func TestParseHugeSize(t *testing.T) {
+	w := &imageWriter{bo: binary.LittleEndian}
+	w.buf.Write(buildImage(binary.LittleEndian))
+	// A valid node truncating etc/motd to 4 GiB, and a hole of 4 GiB
+	w.inode(3, 4, sIFREG|0600, 0xffffffff, 0, nil, ComprNone)
+	hole := w.buf.Len()
+	w.inode(3, 5, sIFREG|0600, 16, 0, nil, ComprZero)
+	img := w.buf.Bytes()
+	binary.LittleEndian.PutUint32(img[hole+52:], 0xffffffff)
+	binary.LittleEndian.PutUint32(img[hole+64:], crc(img[hole:hole+inodeSize-8]))
+
+	fsys, err := Parse(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(fsys.Scan.Errors) != 1 || fsys.Scan.Errors[0].Offset != int64(hole) {
+		t.Errorf("want one error at 0x%x got %v", hole, fsys.Scan.Errors)
+	}
+	if len(fsys.Errors) != 1 {
+		t.Errorf("want one error got %v", fsys.Errors)
+	}
+	got, err := fs.ReadFile(fsys, "etc/motd")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if want := "hello jffs2\x00\x00\x00\x00\x00"; string(got) != want {
+		t.Errorf("contents: want '%q' got '%q'", want, got)
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	// testdata/tree.jffs2 is written by testdata/mkimage.py
+	img, err := ioutil.ReadFile("testdata/tree.jffs2")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	fsys, err := Parse(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if fsys.Scan.ByteOrder != binary.LittleEndian {
+		t.Errorf("byte order: want '%v' got '%v'", binary.LittleEndian, fsys.Scan.ByteOrder)
+	}
+	if len(fsys.Scan.Errors) != 0 || len(fsys.Errors) != 0 {
+		t.Errorf("unexpected errors: %v %v", fsys.Scan.Errors, fsys.Errors)
+	}
+	if fsys.Scan.Cleanmarkers != 2 {
+		t.Errorf("cleanmarkers: want 2 got %v", fsys.Scan.Cleanmarkers)
+	}
+	err = fstest.TestFS(fsys, "bin/busybox", "bin/sh", "etc/empty", "etc/hostname", "etc/motd")
+	if err != nil {
+		t.Fatalf("TestFS failed: %v", err)
+	}
+
+	busybox := make([]byte, 10000)
+	x := uint32(1)
+	for i := range busybox {
+		x = (x*1103515245 + 12345) & 0x7fffffff
+		busybox[i] = byte(x >> 16)
+	}
+	var motd bytes.Buffer
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(&motd, "Welcome to flashbox, line %d\n", i)
+	}
+	for _, tc := range []struct {
+		name string
+		mode fs.FileMode
+		data []byte
+	}{
+		{"bin", fs.ModeDir | 0755, nil},
+		{"bin/busybox", 0755, busybox},
+		{"bin/sh", fs.ModeSymlink | 0777, []byte("busybox")},
+		{"etc/empty", 0644, []byte{}},
+		{"etc/hostname", 0644, []byte("flashbox\n")},
+		{"etc/motd", 0644, motd.Bytes()},
+	} {
+		info, err := fs.Stat(fsys, tc.name)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Mode() != tc.mode {
+			t.Errorf("%v: mode: want '%v' got '%v'", tc.name, tc.mode, info.Mode())
+		}
+		if tc.data == nil {
+			continue
+		}
+		got, err := fs.ReadFile(fsys, tc.name)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !bytes.Equal(got, tc.data) {
+			t.Errorf("%v: contents differ", tc.name)
+		}
+	}
+}
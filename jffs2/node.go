@@ -0,0 +1,173 @@
+// Package jffs2 reads JFFS2 file system images, e.g., dumped from an MTD,
+// and exposes their contents as an fs.FS. A *mtdabi.Device can be parsed
+// directly, as in Parse(dev, int64(dev.Info().Size)).
+//
+// The node format is defined in
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/uapi/linux/jffs2.h.
+// Images of either endianness are supported; the endianness is detected from
+// the first node found.
+package jffs2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Magic is the magic of every JFFS2 node (JFFS2_MAGIC_BITMASK).
+const Magic = 0x1985
+
+// Node types
+const (
+	nodeAccurate = 0x2000
+
+	NodetypeDirent      = 0xe001
+	NodetypeInode       = 0xe002
+	NodetypeCleanmarker = 0x2003
+	NodetypePadding     = 0x2004
+	NodetypeSummary     = 0x2006
+)
+
+// Compression types of inode nodes
+const (
+	ComprNone  = 0x00
+	ComprZero  = 0x01
+	ComprRtime = 0x02
+	ComprZlib  = 0x06
+)
+
+// Sizes of the node structures, without the trailing name or data.
+const (
+	unknownNodeSize = 12
+	direntSize      = 40
+	inodeSize       = 68
+)
+
+// ErrBadCRC is wrapped by the errors of nodes whose CRCs do not match.
+var ErrBadCRC = errors.New("bad CRC")
+
+// crc computes the CRC-32 used by JFFS2, which starts from 0 and omits the
+// final inversion of CRC-32 (IEEE).
+func crc(buf []byte) uint32 {
+	return ^crc32.Update(0xffffffff, crc32.IEEETable, buf)
+}
+
+// Dirent is a directory entry node (struct jffs2_raw_dirent). An Ino of 0
+// unlinks the name.
+type Dirent struct {
+	Pino    uint32
+	Version uint32
+	Ino     uint32
+	Mctime  uint32
+	Type    uint8
+	Name    string
+}
+
+// Inode is an inode node (struct jffs2_raw_inode), holding metadata and a
+// range of the file data.
+type Inode struct {
+	Ino     uint32
+	Version uint32
+	Mode    uint32
+	UID     uint16
+	GID     uint16
+	Isize   uint32
+	Atime   uint32
+	Mtime   uint32
+	Ctime   uint32
+	Offset  uint32
+	Csize   uint32
+	Dsize   uint32
+	Compr   uint8
+	// Data is the decompressed data, Dsize bytes.
+	Data []byte
+}
+
+// NodeError is a node that was skipped because it is invalid.
+type NodeError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node at 0x%x: %v", e.Offset, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// parseDirent decodes the dirent node held by buf.
+func parseDirent(bo binary.ByteOrder, buf []byte) (*Dirent, error) {
+	if len(buf) < direntSize {
+		return nil, fmt.Errorf("dirent truncated")
+	}
+	if got, want := crc(buf[:direntSize-8]), bo.Uint32(buf[32:]); got != want {
+		return nil, fmt.Errorf("dirent node: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	nsize := int(buf[28])
+	if direntSize+nsize > len(buf) {
+		return nil, fmt.Errorf("dirent name truncated")
+	}
+	name := buf[direntSize : direntSize+nsize]
+	if got, want := crc(name), bo.Uint32(buf[36:]); got != want {
+		return nil, fmt.Errorf("dirent name: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	return &Dirent{
+		Pino:    bo.Uint32(buf[12:]),
+		Version: bo.Uint32(buf[16:]),
+		Ino:     bo.Uint32(buf[20:]),
+		Mctime:  bo.Uint32(buf[24:]),
+		Type:    buf[29],
+		Name:    string(name),
+	}, nil
+}
+
+// parseInode decodes the inode node held by buf, decompressing its
+// data. Nodes with more than maxSize bytes of data are rejected rather than
+// allocated.
+func parseInode(bo binary.ByteOrder, buf []byte, maxSize int64) (*Inode, error) {
+	if len(buf) < inodeSize {
+		return nil, fmt.Errorf("inode truncated")
+	}
+	if got, want := crc(buf[:inodeSize-8]), bo.Uint32(buf[64:]); got != want {
+		return nil, fmt.Errorf("inode node: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	n := &Inode{
+		Ino:     bo.Uint32(buf[12:]),
+		Version: bo.Uint32(buf[16:]),
+		Mode:    bo.Uint32(buf[20:]),
+		UID:     bo.Uint16(buf[24:]),
+		GID:     bo.Uint16(buf[26:]),
+		Isize:   bo.Uint32(buf[28:]),
+		Atime:   bo.Uint32(buf[32:]),
+		Mtime:   bo.Uint32(buf[36:]),
+		Ctime:   bo.Uint32(buf[40:]),
+		Offset:  bo.Uint32(buf[44:]),
+		Csize:   bo.Uint32(buf[48:]),
+		Dsize:   bo.Uint32(buf[52:]),
+		Compr:   buf[56],
+	}
+	if int64(n.Dsize) > maxSize {
+		return nil, fmt.Errorf("inode %v version %v: data size 0x%x larger than the image", n.Ino, n.Version, n.Dsize)
+	}
+	if n.Compr == ComprZero {
+		// Holes carry no data
+		n.Data = make([]byte, n.Dsize)
+		return n, nil
+	}
+	if inodeSize+int64(n.Csize) > int64(len(buf)) {
+		return nil, fmt.Errorf("inode data truncated")
+	}
+	cdata := buf[inodeSize : inodeSize+n.Csize]
+	if got, want := crc(cdata), bo.Uint32(buf[60:]); got != want {
+		return nil, fmt.Errorf("inode data: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	var err error
+	n.Data, err = decompress(n.Compr, cdata, int(n.Dsize))
+	if err != nil {
+		return nil, fmt.Errorf("inode %v version %v: %w", n.Ino, n.Version, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,113 @@
+package jffs2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Scan is the result of scanning an image for nodes.
+type Scan struct {
+	// ByteOrder is the endianness of the image, nil if no node was found.
+	ByteOrder binary.ByteOrder
+	// Dirents and Inodes are the valid nodes, in the order found.
+	Dirents []*Dirent
+	Inodes  []*Inode
+	// Cleanmarkers is the number of clean marker nodes found.
+	Cleanmarkers int
+	// Obsolete is the number of nodes marked obsolete, which are skipped.
+	Obsolete int
+	// Errors are the nodes skipped because their header, node or data CRC
+	// does not match, or their data cannot be decompressed.
+	Errors []*NodeError
+
+	// size is the size of the image, which bounds the size of files.
+	size int64
+}
+
+// ScanImage reads the size bytes of an image from r and decodes all nodes.
+// Nodes are found at 4-byte aligned offsets; erased space and garbage between
+// them is skipped. ScanImage only fails if r cannot be read.
+func ScanImage(r io.ReaderAt, size int64) (*Scan, error) {
+	buf := make([]byte, size)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading image: %w", err)
+	}
+	s := &Scan{size: size}
+	off := 0
+	for off+unknownNodeSize <= len(buf) {
+		n := s.scanNode(buf[off:], int64(off))
+		if n <= 0 {
+			off += 4
+			continue
+		}
+		off += (n + 3) &^ 3
+	}
+	return s, nil
+}
+
+// scanNode decodes the node at the start of buf, found at offset off of the
+// image. It returns the length of the node, or 0 if there is no valid node
+// header.
+func (s *Scan) scanNode(buf []byte, off int64) int {
+	if s.ByteOrder == nil {
+		s.ByteOrder = detectByteOrder(buf)
+		if s.ByteOrder == nil {
+			return 0
+		}
+	}
+	bo := s.ByteOrder
+	if bo.Uint16(buf) != Magic {
+		return 0
+	}
+	nodetype := bo.Uint16(buf[2:])
+	totlen := int(bo.Uint32(buf[4:]))
+	if got, want := crc(buf[:8]), bo.Uint32(buf[8:]); got != want {
+		s.Errors = append(s.Errors, &NodeError{
+			Offset: off,
+			Err:    fmt.Errorf("node header: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want),
+		})
+		return 0
+	}
+	if totlen < unknownNodeSize || totlen > len(buf) {
+		s.Errors = append(s.Errors, &NodeError{Offset: off, Err: fmt.Errorf("bad node length %v", totlen)})
+		return 0
+	}
+	if nodetype&nodeAccurate == 0 {
+		s.Obsolete++
+		return totlen
+	}
+	var err error
+	switch nodetype {
+	case NodetypeDirent:
+		var d *Dirent
+		d, err = parseDirent(bo, buf[:totlen])
+		if err == nil {
+			s.Dirents = append(s.Dirents, d)
+		}
+	case NodetypeInode:
+		var n *Inode
+		n, err = parseInode(bo, buf[:totlen], s.size)
+		if err == nil {
+			s.Inodes = append(s.Inodes, n)
+		}
+	case NodetypeCleanmarker:
+		s.Cleanmarkers++
+	}
+	if err != nil {
+		s.Errors = append(s.Errors, &NodeError{Offset: off, Err: err})
+	}
+	return totlen
+}
+
+// detectByteOrder returns the endianness in which buf starts with a node
+// header with valid CRC, or nil.
+func detectByteOrder(buf []byte) binary.ByteOrder {
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if bo.Uint16(buf) == Magic && crc(buf[:8]) == bo.Uint32(buf[8:]) {
+			return bo
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+#!/usr/bin/env python3
+"""Writes tree.jffs2, the known-answer image of the jffs2 tests.
+
+The image mimics the layout mkfs.jffs2 -l -e 0x2000 -p writes for the tree
+below, from the structures of include/uapi/linux/jffs2.h, without sharing
+any code with the package: a clean marker at the start of each eraseblock,
+no inode for the root directory, a dirent followed by the inodes of each
+entry, file data in nodes of at most a 4 KiB page, compressed with zlib
+when that makes it smaller, nodes padded to 4 bytes and never split across
+eraseblocks, and the last eraseblock padded with 0xff.
+
+	/bin/busybox  10000 pseudo-random bytes, in three uncompressed nodes,
+	              the second starting the second eraseblock
+	/bin/sh       symbolic link to busybox
+	/etc/empty    empty file
+	/etc/hostname "flashbox\\n"
+	/etc/motd     compressible text, in one zlib node
+"""
+
+import struct
+import zlib
+
+ERASESIZE = 0x2000
+PAGESIZE = 4096
+MTIME = 1262304000
+
+MAGIC = 0x1985
+CLEANMARKER = 0x2003
+DIRENT = 0xE001
+INODE = 0xE002
+COMPR_NONE = 0x00
+COMPR_ZLIB = 0x06
+
+S_IFDIR = 0o040000
+S_IFREG = 0o100000
+S_IFLNK = 0o120000
+DT_DIR, DT_REG, DT_LNK = 4, 8, 10
+
+
+def crc(data):
+    # crc32(0, data) as in the kernel: no initial or final inversion
+    return ~zlib.crc32(data, 0xFFFFFFFF) & 0xFFFFFFFF
+
+
+def header(nodetype, totlen):
+    hdr = struct.pack("<HHI", MAGIC, nodetype, totlen)
+    return hdr + struct.pack("<I", crc(hdr))
+
+
+class Image:
+    def __init__(self):
+        self.out = bytearray()
+        self.cleanmarker()
+
+    def cleanmarker(self):
+        self.out += header(CLEANMARKER, 12)
+
+    def write(self, node):
+        room = ERASESIZE - len(self.out) % ERASESIZE
+        if len(node) > room:
+            self.out += b"\xff" * room
+            self.cleanmarker()
+        self.out += node
+        self.out += b"\xff" * (-len(self.out) % 4)
+
+    def dirent(self, pino, version, ino, typ, name):
+        name = name.encode()
+        node = header(DIRENT, 40 + len(name))
+        node += struct.pack("<IIIIBBxx", pino, version, ino, MTIME, len(name), typ)
+        node += struct.pack("<I", crc(node))
+        node += struct.pack("<I", crc(name)) + name
+        self.write(node)
+
+    def inode(self, ino, version, mode, isize, offset, data, compr):
+        cdata = data
+        if compr == COMPR_ZLIB:
+            cdata = zlib.compress(data, 9)
+        node = header(INODE, 68 + len(cdata))
+        node += struct.pack("<IIIHHIIIIIIIBBHI", ino, version, mode, 0, 0, isize,
+                            MTIME, MTIME, MTIME, offset, len(cdata), len(data),
+                            compr, compr, 0, crc(cdata))
+        # The node CRC covers neither itself nor the data CRC
+        node += struct.pack("<I", crc(node[:60]))
+        self.write(node + cdata)
+
+    def file(self, ino, mode, data):
+        if not data:
+            self.inode(ino, 1, mode, 0, 0, b"", COMPR_NONE)
+            return
+        version = 0
+        for offset in range(0, len(data), PAGESIZE):
+            page = data[offset:offset + PAGESIZE]
+            compr = COMPR_NONE
+            if len(zlib.compress(page, 9)) < len(page):
+                compr = COMPR_ZLIB
+            version += 1
+            self.inode(ino, version, mode, len(data), offset, page, compr)
+
+
+def busybox():
+    # A linear congruential generator, so the data does not compress
+    x, out = 1, bytearray()
+    for _ in range(10000):
+        x = (x * 1103515245 + 12345) & 0x7FFFFFFF
+        out.append(x >> 16 & 0xFF)
+    return bytes(out)
+
+
+MOTD = b"".join(b"Welcome to flashbox, line %d\n" % i for i in range(64))
+
+img = Image()
+version = 0
+
+
+def dirent(pino, ino, typ, name):
+    global version
+    version += 1
+    img.dirent(pino, version, ino, typ, name)
+
+
+dirent(1, 2, DT_DIR, "bin")
+img.inode(2, 1, S_IFDIR | 0o755, 0, 0, b"", COMPR_NONE)
+dirent(1, 3, DT_DIR, "etc")
+img.inode(3, 1, S_IFDIR | 0o755, 0, 0, b"", COMPR_NONE)
+dirent(2, 4, DT_REG, "busybox")
+img.file(4, S_IFREG | 0o755, busybox())
+dirent(2, 5, DT_LNK, "sh")
+img.inode(5, 1, S_IFLNK | 0o777, 7, 0, b"busybox", COMPR_NONE)
+dirent(3, 6, DT_REG, "empty")
+img.file(6, S_IFREG | 0o644, b"")
+dirent(3, 7, DT_REG, "hostname")
+img.file(7, S_IFREG | 0o644, b"flashbox\n")
+dirent(3, 8, DT_REG, "motd")
+img.file(8, S_IFREG | 0o644, MOTD)
+img.out += b"\xff" * (-len(img.out) % ERASESIZE)
+
+with open("tree.jffs2", "wb") as f:
+    f.write(img.out)
@@ -0,0 +1,87 @@
+package mtdabi
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IsLocked reports whether the region of length bytes at start is locked,
+// using MEMISLOCKED. Unlike MemIsLocked, it returns the lock status the kernel
+// reports as the ioctl return value.
+func (d *Device) IsLocked(start, length int64) (bool, error) {
+	value, err := d.lockRange(start, length)
+	if err != nil {
+		return false, err
+	}
+	defer d.lockRead()()
+	r, err := ioctlRet(d.Fd(), unix.MEMISLOCKED, uintptr(unsafe.Pointer(&value)))
+	if err != nil {
+		return false, err
+	}
+	return r == 1, nil
+}
+
+// LockStatus queries the lock status of every eraseblock overlapping the
+// region of length bytes at start and returns it keyed by eraseblock offset.
+func (d *Device) LockStatus(start, length int64) (map[int64]bool, error) {
+	blocks, err := d.geometry.Blocks(start, length)
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[int64]bool, len(blocks))
+	for _, b := range blocks {
+		locked, err := d.IsLocked(b.Offset, b.Size)
+		if err != nil {
+			return nil, fmt.Errorf("MEMISLOCKED failed for eraseblock at 0x%x: %w", b.Offset, err)
+		}
+		status[b.Offset] = locked
+	}
+	return status, nil
+}
+
+// Lock locks the region of length bytes at start using MEMLOCK. The region
+// is widened to the eraseblocks it overlaps.
+func (d *Device) Lock(start, length int64) error {
+	value, err := d.lockRange(start, length)
+	if err != nil {
+		return err
+	}
+	defer d.lockWrite()()
+	return MemLock(d.Fd(), &value)
+}
+
+// Unlock unlocks the region of length bytes at start using MEMUNLOCK. The
+// region is widened to the eraseblocks it overlaps.
+func (d *Device) Unlock(start, length int64) error {
+	value, err := d.lockRange(start, length)
+	if err != nil {
+		return err
+	}
+	defer d.lockWrite()()
+	return MemUnlock(d.Fd(), &value)
+}
+
+// lockRange widens the region of length bytes at start to the eraseblocks it
+// overlaps, as expected by MEMLOCK, MEMUNLOCK and MEMISLOCKED. Regions
+// ending past 4 GiB cannot be passed to those ioctls.
+func (d *Device) lockRange(start, length int64) (unix.EraseInfo, error) {
+	blocks, err := d.geometry.Blocks(start, length)
+	if err != nil {
+		return unix.EraseInfo{}, err
+	}
+	if len(blocks) == 0 {
+		return unix.EraseInfo{}, fmt.Errorf("lock range at 0x%x: length %v %w", start, length, ErrOutOfBounds)
+	}
+	first, last := blocks[0], blocks[len(blocks)-1]
+	// The ioctls take 32-bit offsets and lengths
+	if last.End() > math.MaxUint32 {
+		return unix.EraseInfo{}, fmt.Errorf("lock range 0x%x-0x%x does not fit 32 bits: %w", first.Offset, last.End(), ErrOutOfBounds)
+	}
+	return unix.EraseInfo{
+		Start:  uint32(first.Offset),
+		Length: uint32(last.End() - first.Offset),
+	}, nil
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"os"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// Device is an MTD device monitored by a FlashCollector.
+type Device struct {
+	// Name is the value of the "device" label of its metrics, e.g., "mtd0".
+	Name  string
+	Flash mtdabi.Flash
+	// Num is the MTD number of the device, for its sysfs attributes. It is
+	// ignored if negative.
+	Num int
+}
+
+// FlashCollector collects the health metrics of MTD devices:
+//
+//	mtd_up                          whether the ECC statistics and sysfs
+//	                                attributes could be read
+//	mtd_ecc_corrected_total         ECC corrections, from ECCGETSTATS
+//	mtd_ecc_failed_total            uncorrectable ECC errors, from ECCGETSTATS
+//	mtd_bad_blocks                  bad eraseblocks, from ECCGETSTATS
+//	mtd_bbt_blocks                  eraseblocks reserved for the bad block
+//	                                table
+//	mtd_sysfs_corrected_bits_total  bitflips corrected by ECC, like
+//	                                mtd_ecc_corrected_total, from sysfs
+//	                                corrected_bits
+//	mtd_size_bytes, mtd_eraseblock_size_bytes, mtd_write_size_bytes,
+//	mtd_oob_size_bytes, mtd_eraseblocks
+//	                                the geometry of the device
+//
+// Errors reading a device set its mtd_up to 0 rather than failing the
+// collection, and the metrics that could not be read are left out.
+type FlashCollector struct {
+	Devices []Device
+	// Sysfs reads the integer sysfs attributes of MTD devices. Nil means
+	// mtdabi.SysfsInt.
+	Sysfs func(mtdNum int, name string) (int64, error)
+}
+
+// Collect returns the metrics of the devices.
+func (c *FlashCollector) Collect() ([]Metric, error) {
+	sysfs := c.Sysfs
+	if sysfs == nil {
+		sysfs = mtdabi.SysfsInt
+	}
+	up := &Metric{Name: "mtd_up", Help: "Whether the ECC statistics and sysfs attributes of the MTD device could be read.", Type: Gauge}
+	corrected := &Metric{Name: "mtd_ecc_corrected_total", Help: "Number of ECC corrections.", Type: Counter}
+	failed := &Metric{Name: "mtd_ecc_failed_total", Help: "Number of uncorrectable ECC errors.", Type: Counter}
+	bad := &Metric{Name: "mtd_bad_blocks", Help: "Number of bad eraseblocks.", Type: Gauge}
+	bbt := &Metric{Name: "mtd_bbt_blocks", Help: "Number of eraseblocks reserved for the bad block table.", Type: Gauge}
+	bits := &Metric{Name: "mtd_sysfs_corrected_bits_total", Help: "Number of bitflips corrected by ECC, from the corrected_bits sysfs attribute.", Type: Counter}
+	size := &Metric{Name: "mtd_size_bytes", Help: "Size of the MTD device.", Type: Gauge}
+	erasesize := &Metric{Name: "mtd_eraseblock_size_bytes", Help: "Size of the eraseblocks.", Type: Gauge}
+	writesize := &Metric{Name: "mtd_write_size_bytes", Help: "Minimal writable unit.", Type: Gauge}
+	oobsize := &Metric{Name: "mtd_oob_size_bytes", Help: "Size of the OOB area of a page.", Type: Gauge}
+	blocks := &Metric{Name: "mtd_eraseblocks", Help: "Number of eraseblocks.", Type: Gauge}
+
+	for _, d := range c.Devices {
+		add := func(m *Metric, v float64) {
+			m.Samples = append(m.Samples, Sample{Labels: map[string]string{"device": d.Name}, Value: v})
+		}
+		ok := true
+		stats, err := d.Flash.ECCStats()
+		if err == nil {
+			add(corrected, float64(stats.Corrected))
+			add(failed, float64(stats.Failed))
+			add(bad, float64(stats.Badblocks))
+			add(bbt, float64(stats.Bbtblocks))
+		} else {
+			ok = false
+		}
+		if d.Num >= 0 {
+			// Flash without ECC has no such attribute
+			v, err := sysfs(d.Num, "corrected_bits")
+			if err == nil {
+				add(bits, float64(v))
+			} else if !os.IsNotExist(err) {
+				ok = false
+			}
+		}
+		if ok {
+			add(up, 1)
+		} else {
+			add(up, 0)
+		}
+
+		info := d.Flash.Info()
+		add(size, float64(info.Size))
+		add(erasesize, float64(info.Erasesize))
+		add(writesize, float64(info.Writesize))
+		add(oobsize, float64(info.Oobsize))
+		n := uint32(0)
+		for _, r := range d.Flash.Geometry().Regions {
+			n += r.Numblocks
+		}
+		add(blocks, float64(n))
+	}
+
+	var metrics []Metric
+	for _, m := range []*Metric{up, corrected, failed, bad, bbt, bits, size, erasesize, writesize, oobsize, blocks} {
+		if len(m.Samples) > 0 {
+			metrics = append(metrics, *m)
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,133 @@
+// Package metrics exports the health of MTD devices as metrics in the
+// Prometheus text exposition format, for device agents to publish without
+// shelling out to mtdinfo or parsing sysfs themselves.
+//
+// A Collector gathers metrics on each scrape; FlashCollector reports the ECC
+// statistics, bad block counts and geometry of MTD devices. Handler serves
+// the metrics of collectors over HTTP.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type is the type of a metric.
+type Type string
+
+// Types of metrics.
+const (
+	Gauge   Type = "gauge"
+	Counter Type = "counter"
+)
+
+// Metric is a family of samples sharing a name.
+type Metric struct {
+	Name string
+	Help string
+	Type Type
+	// Samples are told apart by their labels.
+	Samples []Sample
+}
+
+// Sample is a value of a metric.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Collector gathers metrics.
+type Collector interface {
+	Collect() ([]Metric, error)
+}
+
+// WriteText writes metrics to w in the Prometheus text exposition format.
+// Labels are written sorted by name.
+func WriteText(w io.Writer, metrics []Metric) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if m.Help != "" {
+			fmt.Fprintf(bw, "# HELP %v %v\n", m.Name, escape(m.Help, false))
+		}
+		if m.Type != "" {
+			fmt.Fprintf(bw, "# TYPE %v %v\n", m.Name, m.Type)
+		}
+		for _, s := range m.Samples {
+			bw.WriteString(m.Name)
+			if len(s.Labels) > 0 {
+				names := make([]string, 0, len(s.Labels))
+				for name := range s.Labels {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for i, name := range names {
+					sep := ","
+					if i == 0 {
+						sep = "{"
+					}
+					fmt.Fprintf(bw, "%v%v=\"%v\"", sep, name, escape(s.Labels[name], true))
+				}
+				bw.WriteString("}")
+			}
+			fmt.Fprintf(bw, " %v\n", strconv.FormatFloat(s.Value, 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+// escape escapes backslashes and newlines, and double quotes in label values.
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+// Handler returns an HTTP handler collecting the metrics of collectors on
+// each request and serving them in the text exposition format. If a
+// collector fails, the handler responds with an internal server error.
+// Metrics of the same name from several collectors are merged into one
+// family, which must then have the same type.
+func Handler(collectors ...Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []Metric
+		families := make(map[string]int)
+		for _, c := range collectors {
+			collected, err := c.Collect()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("collecting metrics: %v", err), http.StatusInternalServerError)
+				return
+			}
+			for _, m := range collected {
+				i, ok := families[m.Name]
+				if !ok {
+					families[m.Name] = len(metrics)
+					m.Samples = append([]Sample(nil), m.Samples...)
+					metrics = append(metrics, m)
+					continue
+				}
+				if metrics[i].Type != m.Type {
+					http.Error(w, fmt.Sprintf("metric %v collected as both %v and %v", m.Name, metrics[i].Type, m.Type), http.StatusInternalServerError)
+					return
+				}
+				metrics[i].Samples = append(metrics[i].Samples, m.Samples...)
+			}
+		}
+		var buf bytes.Buffer
+		err := WriteText(&buf, metrics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+)
+
+func TestWriteText(t *testing.T) {
+	metrics := []Metric{{
+		Name: "test_metric",
+		Help: "Help with \\ and\nnewline.",
+		Type: Gauge,
+		Samples: []Sample{
+			{Labels: map[string]string{"b": "2", "a": "quote \" and \\"}, Value: 1.5},
+			{Value: 3},
+		},
+	}}
+	var buf bytes.Buffer
+	err := WriteText(&buf, metrics)
+	if err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	want := `# HELP test_metric Help with \\ and\nnewline.
+# TYPE test_metric gauge
+test_metric{a="quote \" and \\",b="2"} 1.5
+test_metric 3
+`
+	if buf.String() != want {
+		t.Errorf("WriteText: want '%v' got '%v'", want, buf.String())
+	}
+}
+
+type failingCollector struct{}
+
+func (failingCollector) Collect() ([]Metric, error) {
+	return nil, errors.New("no metrics")
+}
+
+func TestHandler(t *testing.T) {
+	sim := mtdsim.NewSmallNAND(0x4000)
+	err := sim.Inject(mtdsim.Fault{Kind: mtdsim.FaultBitflips, Offset: 0, Bitflips: 3, Count: 1})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	sim.ReadAt(make([]byte, 1), 0)
+
+	c := &FlashCollector{
+		Devices: []Device{{Name: "mtd0", Flash: sim, Num: 0}, {Name: "mtd1", Flash: sim, Num: 1}},
+		Sysfs: func(mtdNum int, name string) (int64, error) {
+			if name != "corrected_bits" {
+				t.Errorf("Unexpected sysfs attribute '%v'", name)
+			}
+			if mtdNum == 1 {
+				return 0, os.ErrPermission
+			}
+			return 3, nil
+		},
+	}
+	server := httptest.NewServer(Handler(c))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Reading response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected response %v with content type '%v'", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE mtd_ecc_corrected_total counter",
+		"# TYPE mtd_sysfs_corrected_bits_total counter",
+		`mtd_up{device="mtd0"} 1`,
+		// Reading the sysfs attribute of the second device fails
+		`mtd_up{device="mtd1"} 0`,
+		`mtd_ecc_corrected_total{device="mtd0"} 3`,
+		`mtd_ecc_failed_total{device="mtd0"} 0`,
+		`mtd_bad_blocks{device="mtd0"} 1`,
+		`mtd_sysfs_corrected_bits_total{device="mtd0"} 3`,
+		`mtd_size_bytes{device="mtd0"} 65536`,
+		`mtd_eraseblocks{device="mtd1"} 4`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Response lacks '%v':\n%s", line, body)
+		}
+	}
+	if strings.Contains(string(body), `mtd_sysfs_corrected_bits_total{device="mtd1"}`) {
+		t.Errorf("Response has corrected bits of mtd1:\n%s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(c, failingCollector{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Failing collector: want status %v got %v", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+// staticCollector returns the same metrics on each scrape.
+type staticCollector []Metric
+
+func (c staticCollector) Collect() ([]Metric, error) {
+	return c, nil
+}
+
+func TestHandlerMerge(t *testing.T) {
+	sim := mtdsim.NewSmallNAND()
+	sysfs := func(mtdNum int, name string) (int64, error) {
+		return 0, nil
+	}
+	// One collector per device, sharing all families
+	c0 := &FlashCollector{Devices: []Device{{Name: "mtd0", Flash: sim, Num: 0}}, Sysfs: sysfs}
+	c1 := &FlashCollector{Devices: []Device{{Name: "mtd1", Flash: sim, Num: 1}}, Sysfs: sysfs}
+	rec := httptest.NewRecorder()
+	Handler(c0, c1).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status %v got %v", http.StatusOK, rec.Code)
+	}
+	body := rec.Body.String()
+	if n := strings.Count(body, "# TYPE mtd_up gauge\n"); n != 1 {
+		t.Errorf("want one TYPE line for mtd_up got %v:\n%s", n, body)
+	}
+	want := "mtd_up{device=\"mtd0\"} 1\nmtd_up{device=\"mtd1\"} 1\n"
+	if !strings.Contains(body, want) {
+		t.Errorf("Response lacks '%v':\n%s", want, body)
+	}
+
+	conflict := staticCollector{{Name: "mtd_up", Type: Counter, Samples: []Sample{{Value: 1}}}}
+	rec = httptest.NewRecorder()
+	Handler(c0, conflict).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Conflicting types: want status %v got %v", http.StatusInternalServerError, rec.Code)
+	}
+}
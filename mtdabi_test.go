@@ -11,7 +11,9 @@ import (
 	"os/exec"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -719,3 +721,500 @@ func TestMtdFileMode(t *testing.T) {
 		t.Fatalf("MtdFileMode failed: %v", err)
 	}
 }
+
+// Tests Device.ReadOOB, Device.WriteOOB
+func TestDeviceReadWriteOOB(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	err = eraseAndCheckMtd(dev.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := int64(mtdInfo.Writesize) * 3
+	buf := make([]byte, mtdInfo.Oobsize)
+	err = dev.ReadOOB(offset, buf)
+	if err != nil {
+		t.Fatalf("ReadOOB failed: %v", err)
+	}
+	if !allErased(buf) {
+		t.Fatalf("Oob: want all erased, got '%v'", buf)
+	}
+
+	writeBuf, err := genRandomBytes(int(mtdInfo.Oobsize))
+	if err != nil {
+		t.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	err = dev.WriteOOB(offset, writeBuf)
+	if err != nil {
+		t.Fatalf("WriteOOB failed: %v", err)
+	}
+	err = dev.ReadOOB(offset, buf)
+	if err != nil {
+		t.Fatalf("ReadOOB failed: %v", err)
+	}
+	if !bytes.Equal(buf, writeBuf) {
+		t.Fatalf("Oob: want '%v', got '%v'", writeBuf, buf)
+	}
+
+	// Lengths past the OOB area of a page must be rejected before the ioctl
+	err = dev.ReadOOB(offset, make([]byte, mtdInfo.Oobsize+1))
+	if err == nil {
+		t.Fatalf("ReadOOB: want error for oversized buffer")
+	}
+	err = dev.WriteOOB(offset, nil)
+	if err == nil {
+		t.Fatalf("WriteOOB: want error for empty buffer")
+	}
+
+	err = eraseAndCheckMtd(dev.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests Device.Write
+func TestDeviceWrite(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	err = eraseAndCheckMtd(dev.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeData, err := genRandomBytes(int(mtdInfo.Writesize) * 2)
+	if err != nil {
+		t.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	offset := int64(mtdInfo.Erasesize)
+	err = dev.Write(offset, writeData, nil, unix.MTD_OPS_PLACE_OOB)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	readData := make([]byte, len(writeData))
+	_, err = dev.ReadAt(readData, offset)
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(readData, writeData) {
+		t.Fatalf("Write failed: want '%v' got '%v'", writeData, readData)
+	}
+
+	err = dev.Write(offset, nil, nil, unix.MTD_OPS_PLACE_OOB)
+	if err == nil {
+		t.Fatalf("Write: want error for empty request")
+	}
+	err = dev.Write(offset, writeData, make([]byte, mtdInfo.Oobsize*3), unix.MTD_OPS_PLACE_OOB)
+	if err == nil {
+		t.Fatalf("Write: want error for oversized OOB")
+	}
+
+	err = eraseAndCheckMtd(dev.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests CheckErase, CheckWrite, CheckOOB through Device
+func TestDeviceValidation(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	size := int64(mtdInfo.Size)
+	erasesize := int64(mtdInfo.Erasesize)
+	writesize := int(mtdInfo.Writesize)
+
+	err = dev.Erase(1, erasesize)
+	if !errors.Is(err, ErrUnaligned) {
+		t.Errorf("Erase unaligned start err: want '%v' got '%v'", ErrUnaligned, err)
+	}
+	err = dev.Erase(0, erasesize+1)
+	if !errors.Is(err, ErrUnaligned) {
+		t.Errorf("Erase unaligned length err: want '%v' got '%v'", ErrUnaligned, err)
+	}
+	err = dev.Erase(size-erasesize, erasesize*2)
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Erase past end err: want '%v' got '%v'", ErrOutOfBounds, err)
+	}
+	_, err = dev.WriteAt(make([]byte, writesize), 1)
+	if !errors.Is(err, ErrUnaligned) {
+		t.Errorf("WriteAt unaligned err: want '%v' got '%v'", ErrUnaligned, err)
+	}
+	err = dev.Write(size, make([]byte, writesize), nil, unix.MTD_OPS_PLACE_OOB)
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Write past end err: want '%v' got '%v'", ErrOutOfBounds, err)
+	}
+	err = dev.Write(0, make([]byte, writesize), make([]byte, mtdInfo.Oobsize+1), unix.MTD_OPS_PLACE_OOB)
+	if !errors.Is(err, ErrOOBLength) {
+		t.Errorf("Write oversized OOB err: want '%v' got '%v'", ErrOOBLength, err)
+	}
+	err = dev.ReadOOB(4, make([]byte, mtdInfo.Oobsize))
+	if !errors.Is(err, ErrOOBLength) {
+		t.Errorf("ReadOOB oversized err: want '%v' got '%v'", ErrOOBLength, err)
+	}
+
+	// Without validation the kernel gets to reject the request instead
+	dev.NoValidate = true
+	err = dev.Erase(1, erasesize)
+	if err != unix.EINVAL {
+		t.Errorf("Erase unaligned start err: want '%v' got '%v'", unix.EINVAL, err)
+	}
+}
+
+// Tests NewGeometry and Geometry on a device with erase regions, and on the
+// simulated MTD which has none
+func TestGeometry(t *testing.T) {
+	// A bottom boot-sector NOR flash: 8 x 8KiB parameter blocks followed by
+	// 15 x 64KiB main blocks
+	info := unix.MtdInfo{
+		Type:      unix.MTD_NORFLASH,
+		Size:      0x100000,
+		Erasesize: 0x10000,
+		Writesize: 1,
+	}
+	regions := []unix.RegionInfo{
+		{Offset: 0x10000, Erasesize: 0x10000, Numblocks: 15, Regionindex: 1},
+		{Offset: 0, Erasesize: 0x2000, Numblocks: 8, Regionindex: 0},
+	}
+	g, err := NewGeometry(info, regions)
+	if err != nil {
+		t.Fatalf("NewGeometry failed: %v", err)
+	}
+
+	b, err := g.BlockAt(0x3001)
+	if err != nil {
+		t.Fatalf("BlockAt failed: %v", err)
+	}
+	if want := (Block{Offset: 0x2000, Size: 0x2000}); b != want {
+		t.Errorf("BlockAt: want '%v' got '%v'", want, b)
+	}
+	next, err := g.NextBoundary(0x1ffff)
+	if err != nil {
+		t.Fatalf("NextBoundary failed: %v", err)
+	}
+	if next != 0x20000 {
+		t.Errorf("NextBoundary: want '%v' got '%v'", 0x20000, next)
+	}
+	_, err = g.BlockAt(0x100000)
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("BlockAt err: want '%v' got '%v'", ErrOutOfBounds, err)
+	}
+
+	blocks, err := g.Blocks(0xe000, 0x4000)
+	if err != nil {
+		t.Fatalf("Blocks failed: %v", err)
+	}
+	wantBlocks := []Block{{Offset: 0xe000, Size: 0x2000}, {Offset: 0x10000, Size: 0x10000}}
+	if !reflect.DeepEqual(wantBlocks, blocks) {
+		t.Errorf("Blocks: want '%v' got '%v'", wantBlocks, blocks)
+	}
+
+	err = g.CheckErase(0x2000, 0x2000)
+	if err != nil {
+		t.Errorf("CheckErase failed: %v", err)
+	}
+	err = g.CheckErase(0xe000, 0x4000)
+	if !errors.Is(err, ErrUnaligned) {
+		t.Errorf("CheckErase err: want '%v' got '%v'", ErrUnaligned, err)
+	}
+
+	_, err = NewGeometry(info, regions[:1])
+	if err == nil {
+		t.Errorf("NewGeometry: want error for regions not covering the MTD")
+	}
+	_, err = NewGeometry(unix.MtdInfo{Size: 0x10200, Erasesize: 0x4000}, nil)
+	if err == nil {
+		t.Errorf("NewGeometry: want error for a size not a multiple of the erase size")
+	}
+
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+	wantRegions := []unix.RegionInfo{{Offset: 0, Erasesize: mtdInfo.Erasesize, Numblocks: mtdInfo.Size / mtdInfo.Erasesize}}
+	if !reflect.DeepEqual(wantRegions, dev.Geometry().Regions) {
+		t.Errorf("Regions: want '%v' got '%v'", wantRegions, dev.Geometry().Regions)
+	}
+}
+
+// Tests Device.IsLocked, Device.LockStatus, Device.Lock, Device.Unlock
+func TestDeviceLock(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	// Unaligned ranges are widened to eraseblocks, so these reach the kernel,
+	// which cannot lock this MTD
+	_, err = dev.IsLocked(1, 1)
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("IsLocked err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+	_, err = dev.LockStatus(0, int64(mtdInfo.Erasesize)*2)
+	if !errors.Is(err, unix.EOPNOTSUPP) {
+		t.Errorf("LockStatus err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+	err = dev.Lock(1, int64(mtdInfo.Erasesize))
+	if err != errENOTSUPP {
+		t.Errorf("Lock err: want '%v' got '%v'", errENOTSUPP, err)
+	}
+	err = dev.Unlock(1, int64(mtdInfo.Erasesize))
+	if err != errENOTSUPP {
+		t.Errorf("Unlock err: want '%v' got '%v'", errENOTSUPP, err)
+	}
+
+	err = dev.Lock(int64(mtdInfo.Size), 1)
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Lock past end err: want '%v' got '%v'", ErrOutOfBounds, err)
+	}
+}
+
+// Tests Device.OTPRegions, Device.ReadOTP, Device.WriteOTP, Device.LockOTP
+// Because this is not an OTP flash, selecting an OTP mode fails with EOPNOTSUPP
+// and the device must be left in its previous mode
+func TestDeviceOTP(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	_, err = dev.OTPRegions(OTPFactory)
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("OTPRegions err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+	_, err = dev.ReadOTP(OTPUser)
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("ReadOTP err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+	err = dev.WriteOTP(0, []byte{0x12, 0x34})
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("WriteOTP err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+	err = dev.LockOTP(0, 2)
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("LockOTP err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+	if dev.FileMode() != unix.MTD_FILE_MODE_NORMAL {
+		t.Errorf("FileMode: want '%v' got '%v'", unix.MTD_FILE_MODE_NORMAL, dev.FileMode())
+	}
+}
+
+// Tests WithFileMode, Device.ReadRawPage, Device.WriteRawPage
+func TestRawPage(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	err = eraseAndCheckMtd(dev.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := int64(mtdInfo.Erasesize) + int64(mtdInfo.Writesize)
+	writeData, err := genRandomBytes(int(mtdInfo.Writesize))
+	if err != nil {
+		t.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	writeOob, err := genRandomBytes(int(mtdInfo.Oobsize))
+	if err != nil {
+		t.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	err = dev.WriteRawPage(offset, writeData, writeOob)
+	if err != nil {
+		t.Fatalf("WriteRawPage failed: %v", err)
+	}
+	data, oob, err := dev.ReadRawPage(offset)
+	if err != nil {
+		t.Fatalf("ReadRawPage failed: %v", err)
+	}
+	if !bytes.Equal(data, writeData) {
+		t.Errorf("Raw data: want '%v' got '%v'", writeData, data)
+	}
+	// Without ECC, the OOB area holds exactly what was written
+	if !bytes.Equal(oob, writeOob) {
+		t.Errorf("Raw OOB: want '%v' got '%v'", writeOob, oob)
+	}
+	if dev.FileMode() != unix.MTD_FILE_MODE_NORMAL {
+		t.Errorf("FileMode: want '%v' got '%v'", unix.MTD_FILE_MODE_NORMAL, dev.FileMode())
+	}
+
+	_, _, err = dev.ReadRawPage(offset + 1)
+	if !errors.Is(err, ErrUnaligned) {
+		t.Errorf("ReadRawPage err: want '%v' got '%v'", ErrUnaligned, err)
+	}
+
+	// The previous mode is restored even if the function fails
+	wantErr := errors.New("failed in raw mode")
+	err = WithFileMode(dev, unix.MTD_FILE_MODE_RAW, func() error {
+		if dev.FileMode() != unix.MTD_FILE_MODE_RAW {
+			t.Errorf("FileMode: want '%v' got '%v'", unix.MTD_FILE_MODE_RAW, dev.FileMode())
+		}
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("WithFileMode err: want '%v' got '%v'", wantErr, err)
+	}
+	if dev.FileMode() != unix.MTD_FILE_MODE_NORMAL {
+		t.Errorf("FileMode: want '%v' got '%v'", unix.MTD_FILE_MODE_NORMAL, dev.FileMode())
+	}
+
+	err = eraseAndCheckMtd(dev.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests Device.AddPartition, Device.DelPartition, SysfsAttr, SysfsInt
+func TestBlkpg(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	err = dev.AddPartition("blkpg-test", 1, int64(mtdInfo.Erasesize))
+	if !errors.Is(err, ErrUnaligned) {
+		t.Errorf("AddPartition err: want '%v' got '%v'", ErrUnaligned, err)
+	}
+	err = dev.AddPartition("", 0, int64(mtdInfo.Erasesize))
+	if err == nil {
+		t.Errorf("AddPartition with empty name succeeded")
+	}
+
+	// nandsim is the only MTD, so the partition becomes mtd1
+	err = dev.AddPartition("blkpg-test", int64(mtdInfo.Erasesize), int64(mtdInfo.Erasesize))
+	if err != nil {
+		t.Fatalf("AddPartition failed: %v", err)
+	}
+	name, err := SysfsAttr(1, "name")
+	if err != nil {
+		t.Errorf("SysfsAttr failed: %v", err)
+	} else if name != "blkpg-test" {
+		t.Errorf("Partition name: want 'blkpg-test' got '%v'", name)
+	}
+	size, err := SysfsInt(1, "size")
+	if err != nil {
+		t.Errorf("SysfsInt failed: %v", err)
+	} else if size != int64(mtdInfo.Erasesize) {
+		t.Errorf("Partition size: want '%v' got '%v'", mtdInfo.Erasesize, size)
+	}
+	err = dev.DelPartition(1)
+	if err != nil {
+		t.Fatalf("DelPartition failed: %v", err)
+	}
+	_, err = SysfsAttr(1, "name")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("SysfsAttr after delete err: want '%v' got '%v'", os.ErrNotExist, err)
+	}
+}
+
+// Tests Device.IsBad
+func TestDeviceIsBad(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+
+	bad, err := dev.IsBad(int64(mtdInfo.Erasesize) + 1)
+	if err != nil {
+		t.Fatalf("IsBad failed: %v", err)
+	}
+	if bad {
+		t.Errorf("IsBad: want 'false' got '%v'", bad)
+	}
+	_, err = dev.IsBad(int64(mtdInfo.Size))
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("IsBad err: want '%v' got '%v'", ErrOutOfBounds, err)
+	}
+}
+
+// Tests concurrent use of a Device
+func TestDeviceConcurrency(t *testing.T) {
+	dev, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer dev.Close()
+	erasesize := int64(mtdInfo.Erasesize)
+
+	// Goroutines erase and rewrite their own eraseblock concurrently
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := int64(0); i < 4; i++ {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			page := bytes.Repeat([]byte{byte(offset / erasesize)}, int(mtdInfo.Writesize))
+			buf := make([]byte, len(page))
+			for j := 0; j < 10; j++ {
+				err := dev.Erase(offset, erasesize)
+				if err == nil {
+					_, err = dev.WriteAt(page, offset)
+				}
+				if err == nil {
+					_, err = dev.ReadAt(buf, offset)
+				}
+				if err == nil && !bytes.Equal(buf, page) {
+					err = fmt.Errorf("eraseblock at 0x%x read back differs", offset)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i * erasesize)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent access failed: %v", err)
+	}
+
+	// Exclusive keeps out other goroutines, and other open files using flock
+	other, err := Open(mtdPath)
+	if err != nil {
+		t.Fatalf("Failed to open MTD device: %v", err)
+	}
+	defer other.Close()
+	err = dev.Exclusive(func(held *Device) error {
+		read := make(chan struct{})
+		go func() {
+			dev.ReadAt(make([]byte, 1), 0)
+			close(read)
+		}()
+		err := unix.Flock(int(other.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err != unix.EWOULDBLOCK {
+			return fmt.Errorf("flock: want '%v' got '%v'", unix.EWOULDBLOCK, err)
+		}
+		select {
+		case <-read:
+			return errors.New("read ran during Exclusive")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return held.Erase(0, erasesize)
+	})
+	if err != nil {
+		t.Fatalf("Exclusive failed: %v", err)
+	}
+	err = unix.Flock(int(other.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		t.Errorf("flock after Exclusive failed: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package mtdparts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIS directory format, as read by
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/drivers/mtd/parsers/redboot.c.
+const (
+	// FISEntrySize is the size of an entry (struct fis_image_desc)
+	FISEntrySize = 256
+	// fisNameSize is the size of the name of an entry
+	fisNameSize = 16
+	// fisDirectoryName is the name of the entry of the directory itself
+	fisDirectoryName = "FIS directory"
+)
+
+// ParseFIS parses a RedBoot FIS directory, dir being the contents of the
+// eraseblock holding it, into the partitions it describes, in directory
+// order. The endianness of the directory is detected from the entry
+// describing the directory itself, which spans one eraseblock, or less if
+// RedBoot combined it with its configuration. Like the
+// kernel, flash addresses are masked with the MTD size, which must be a power
+// of two, to get offsets. The partitions are not checked for alignment or
+// overlaps; use Table.Resolve for that.
+func ParseFIS(dir []byte, info unix.MtdInfo) ([]Partition, error) {
+	bo, err := fisByteOrder(dir, info)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Partition
+	for _, entry := range fisEntries(dir) {
+		base := bo.Uint32(entry[fisNameSize:])
+		size := bo.Uint32(entry[fisNameSize+8:])
+		parts = append(parts, Partition{
+			Name:   fisName(entry),
+			Offset: int64(base & (info.Size - 1)),
+			Size:   int64(size),
+		})
+	}
+	return parts, nil
+}
+
+// ReadFIS reads the FIS directory from eraseblock block of r, an MTD
+// described by info, and parses it. A negative block counts from the end, so
+// -1 is the last eraseblock, where RedBoot puts the directory by default.
+func ReadFIS(r io.ReaderAt, info unix.MtdInfo, block int) ([]Partition, error) {
+	if info.Erasesize == 0 {
+		return nil, fmt.Errorf("invalid eraseblock size 0")
+	}
+	blocks := int(info.Size / info.Erasesize)
+	if block < 0 {
+		block += blocks
+	}
+	if block < 0 || block >= blocks {
+		return nil, fmt.Errorf("FIS directory block %v out of %v", block, blocks)
+	}
+	dir := make([]byte, info.Erasesize)
+	_, err := r.ReadAt(dir, int64(block)*int64(info.Erasesize))
+	if err != nil {
+		return nil, fmt.Errorf("reading FIS directory: %w", err)
+	}
+	return ParseFIS(dir, info)
+}
+
+// fisByteOrder finds the entry of the directory itself and returns the byte
+// order in which its size is one eraseblock. RedBoot can combine the
+// directory and its configuration in one eraseblock, so like the kernel,
+// failing that, it returns the byte order in which the size fits within an
+// eraseblock while the swapped size does not.
+func fisByteOrder(dir []byte, info unix.MtdInfo) (binary.ByteOrder, error) {
+	if info.Size&(info.Size-1) != 0 {
+		return nil, fmt.Errorf("MTD size 0x%x not a power of two", info.Size)
+	}
+	for _, entry := range fisEntries(dir) {
+		if fisName(entry) != fisDirectoryName {
+			continue
+		}
+		be := binary.BigEndian.Uint32(entry[fisNameSize+8:])
+		le := binary.LittleEndian.Uint32(entry[fisNameSize+8:])
+		switch {
+		case be == info.Erasesize:
+			return binary.BigEndian, nil
+		case le == info.Erasesize:
+			return binary.LittleEndian, nil
+		case be < info.Erasesize && le > info.Erasesize:
+			return binary.BigEndian, nil
+		case le < info.Erasesize && be > info.Erasesize:
+			return binary.LittleEndian, nil
+		}
+		return nil, fmt.Errorf("FIS directory entry: size does not fit in one eraseblock")
+	}
+	return nil, fmt.Errorf("no FIS directory entry found")
+}
+
+// fisEntries returns the entries of the directory in use. Like the kernel,
+// entries whose name starts with 0xff are deleted, and the directory ends at
+// the first entry whose name starts with two 0xff bytes.
+func fisEntries(dir []byte) [][]byte {
+	var entries [][]byte
+	for off := 0; off+FISEntrySize <= len(dir); off += FISEntrySize {
+		entry := dir[off : off+FISEntrySize]
+		if entry[0] == 0xff {
+			if entry[1] == 0xff {
+				// End of directory
+				break
+			}
+			// Deleted entry
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// fisName returns the NUL-terminated name of an entry.
+func fisName(entry []byte) string {
+	name := entry[:fisNameSize]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return string(name)
+}
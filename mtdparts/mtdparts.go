@@ -0,0 +1,344 @@
+// Package mtdparts parses and generates MTD partition tables: the
+// `mtdparts=` kernel command line syntax of the cmdlinepart parser, and
+// RedBoot FIS directories.
+//
+// The command line syntax is documented in
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/drivers/mtd/parsers/cmdlinepart.c:
+//
+//	mtdparts=<mtddef>[;<mtddef>]
+//	<mtddef>  := <mtd-id>:<partdef>[,<partdef>]
+//	<partdef> := <size>[@<offset>][<name>][ro][lk][slc]
+//	<size>    := memsize or "-" for the remaining space
+//	<name>    := '(' NAME ')'
+package mtdparts
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SizeRemaining is the Size of a partition spanning the remaining space
+	// of the MTD ("-").
+	SizeRemaining = -1
+	// OffsetNext is the Offset of a partition starting where the previous
+	// one ends, or at 0 for the first partition.
+	OffsetNext = -1
+)
+
+// Errors of Resolve, to be tested with errors.Is.
+var (
+	// ErrUnaligned means a partition does not start or end on an eraseblock
+	// boundary.
+	ErrUnaligned = errors.New("partition not aligned to eraseblocks")
+	// ErrOutOfBounds means a partition ends past the end of the MTD.
+	ErrOutOfBounds = errors.New("partition beyond end of device")
+	// ErrOverlap means two partitions overlap.
+	ErrOverlap = errors.New("partitions overlap")
+)
+
+// Partition is a partition of an MTD.
+type Partition struct {
+	Name string
+	// Offset is the offset of the partition in the MTD, or OffsetNext.
+	Offset int64
+	// Size is the size of the partition, or SizeRemaining.
+	Size int64
+	// ReadOnly marks the partition read-only ("ro").
+	ReadOnly bool
+	// Lock keeps the partition locked after power-up instead of unlocking
+	// it ("lk", MTD_POWERUP_LOCK).
+	Lock bool
+	// SLC makes MLC NAND partitions be used in SLC mode ("slc").
+	SLC bool
+}
+
+// End returns the offset following the partition. It is only meaningful for
+// resolved partitions.
+func (p Partition) End() int64 {
+	return p.Offset + p.Size
+}
+
+// Table is the partition table of one MTD, identified by its name
+// (unix.MtdInfo does not hold it; see the "name" sysfs attribute).
+type Table struct {
+	ID         string
+	Partitions []Partition
+}
+
+// Parse parses an mtdparts string, with or without the `mtdparts=` prefix,
+// into one table per MTD. Offsets and sizes are left as written; use
+// Table.Resolve to validate them against an MTD.
+func Parse(s string) ([]Table, error) {
+	s = strings.TrimPrefix(s, "mtdparts=")
+	if s == "" {
+		return nil, fmt.Errorf("empty mtdparts")
+	}
+	var tables []Table
+	for _, def := range strings.Split(s, ";") {
+		t, err := parseTable(def)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// parseTable parses a <mtddef>.
+func parseTable(def string) (Table, error) {
+	// Both the ID and the names may contain colons: take the last colon
+	// before the first name
+	head := def
+	if i := strings.IndexByte(def, '('); i >= 0 {
+		head = def[:i]
+	}
+	i := strings.LastIndexByte(head, ':')
+	if i <= 0 {
+		return Table{}, fmt.Errorf("mtdparts %q: missing mtd-id", def)
+	}
+	t := Table{ID: def[:i]}
+	rest := def[i+1:]
+	for rest != "" {
+		p, n, err := parsePartition(rest)
+		if err != nil {
+			return Table{}, fmt.Errorf("mtdparts %q: %w", t.ID, err)
+		}
+		t.Partitions = append(t.Partitions, p)
+		rest = rest[n:]
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' || len(rest) == 1 {
+			return Table{}, fmt.Errorf("mtdparts %q: unexpected %q", t.ID, rest)
+		}
+		rest = rest[1:]
+	}
+	if len(t.Partitions) == 0 {
+		return Table{}, fmt.Errorf("mtdparts %q: no partitions", t.ID)
+	}
+	return t, nil
+}
+
+// parsePartition parses the <partdef> at the start of s, returning its length.
+func parsePartition(s string) (Partition, int, error) {
+	p := Partition{Offset: OffsetNext}
+	pos := 0
+	if strings.HasPrefix(s, "-") {
+		p.Size = SizeRemaining
+		pos = 1
+	} else {
+		size, n, err := parseMemsize(s)
+		if err != nil {
+			return p, 0, fmt.Errorf("size: %w", err)
+		}
+		p.Size = size
+		pos = n
+	}
+	if strings.HasPrefix(s[pos:], "@") {
+		offset, n, err := parseMemsize(s[pos+1:])
+		if err != nil {
+			return p, 0, fmt.Errorf("offset: %w", err)
+		}
+		p.Offset = offset
+		pos += 1 + n
+	}
+	if strings.HasPrefix(s[pos:], "(") {
+		end := strings.IndexByte(s[pos:], ')')
+		if end < 0 {
+			return p, 0, fmt.Errorf("unterminated name %q", s[pos:])
+		}
+		p.Name = s[pos+1 : pos+end]
+		pos += end + 1
+	}
+	for {
+		switch {
+		case strings.HasPrefix(s[pos:], "ro"):
+			p.ReadOnly = true
+			pos += 2
+		case strings.HasPrefix(s[pos:], "lk"):
+			p.Lock = true
+			pos += 2
+		case strings.HasPrefix(s[pos:], "slc"):
+			p.SLC = true
+			pos += 3
+		default:
+			return p, pos, nil
+		}
+	}
+}
+
+// parseMemsize parses a number with an optional K, M, G, T, P or E suffix at
+// the start of s, like the kernel's memparse, returning its length.
+func parseMemsize(s string) (int64, int, error) {
+	n := 0
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base = 16
+		n = 2
+	case strings.HasPrefix(s, "0") && len(s) > 1 && s[1] >= '0' && s[1] <= '7':
+		base = 8
+		n = 1
+	}
+	start := n
+	for n < len(s) && isDigit(s[n], base) {
+		n++
+	}
+	if n == start {
+		return 0, 0, fmt.Errorf("invalid number %q", s)
+	}
+	v, err := strconv.ParseInt(s[start:n], base, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n < len(s) {
+		shift := strings.IndexByte("KMGTPE", upper(s[n]))
+		if shift >= 0 {
+			v <<= 10 * uint(shift+1)
+			n++
+		}
+	}
+	return v, n, nil
+}
+
+func isDigit(c byte, base int) bool {
+	switch base {
+	case 8:
+		return c >= '0' && c <= '7'
+	case 16:
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	return c >= '0' && c <= '9'
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// Resolve returns the partitions of t with their offsets and sizes computed
+// like cmdlinepart does, validated against the MTD described by info: every
+// partition must be non-empty, start and end on eraseblock boundaries, lie
+// within the MTD, and not overlap the others.
+func (t Table) Resolve(info unix.MtdInfo) ([]Partition, error) {
+	size := int64(info.Size)
+	erasesize := int64(info.Erasesize)
+	if erasesize == 0 {
+		return nil, fmt.Errorf("invalid eraseblock size 0")
+	}
+	parts := make([]Partition, len(t.Partitions))
+	var next int64
+	for i, p := range t.Partitions {
+		if p.Offset == OffsetNext {
+			p.Offset = next
+		}
+		if p.Size == SizeRemaining {
+			if i != len(t.Partitions)-1 {
+				return nil, fmt.Errorf("partition %v %q: size \"-\" must be last", i, p.Name)
+			}
+			p.Size = size - p.Offset
+		}
+		switch {
+		case p.Offset < 0 || p.Size <= 0:
+			return nil, fmt.Errorf("partition %v %q: invalid offset 0x%x size 0x%x", i, p.Name, p.Offset, p.Size)
+		case p.End() > size:
+			return nil, fmt.Errorf("partition %v %q: end 0x%x: %w 0x%x", i, p.Name, p.End(), ErrOutOfBounds, size)
+		case p.Offset%erasesize != 0 || p.Size%erasesize != 0:
+			return nil, fmt.Errorf("partition %v %q: offset 0x%x size 0x%x: %w of 0x%x",
+				i, p.Name, p.Offset, p.Size, ErrUnaligned, erasesize)
+		}
+		for j := 0; j < i; j++ {
+			if p.Offset < parts[j].End() && parts[j].Offset < p.End() {
+				return nil, fmt.Errorf("partition %v %q and %v %q: %w", i, p.Name, j, parts[j].Name, ErrOverlap)
+			}
+		}
+		parts[i] = p
+		next = p.End()
+	}
+	return parts, nil
+}
+
+// String returns the <mtddef> of t.
+func (t Table) String() string {
+	var b strings.Builder
+	b.WriteString(t.ID)
+	b.WriteByte(':')
+	for i, p := range t.Partitions {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+// String returns the <partdef> of p.
+func (p Partition) String() string {
+	var b strings.Builder
+	if p.Size == SizeRemaining {
+		b.WriteByte('-')
+	} else {
+		b.WriteString(formatMemsize(p.Size))
+	}
+	if p.Offset != OffsetNext {
+		b.WriteByte('@')
+		b.WriteString(formatMemsize(p.Offset))
+	}
+	if p.Name != "" {
+		b.WriteString("(" + p.Name + ")")
+	}
+	if p.ReadOnly {
+		b.WriteString("ro")
+	}
+	if p.Lock {
+		b.WriteString("lk")
+	}
+	if p.SLC {
+		b.WriteString("slc")
+	}
+	return b.String()
+}
+
+// formatMemsize formats v with the largest suffix dividing it.
+func formatMemsize(v int64) string {
+	if v == 0 {
+		return "0"
+	}
+	suffix := ""
+	for _, s := range []string{"k", "m", "g"} {
+		if v%1024 != 0 {
+			break
+		}
+		v /= 1024
+		suffix = s
+	}
+	return strconv.FormatInt(v, 10) + suffix
+}
+
+// Format returns the mtdparts string of tables, with the `mtdparts=` prefix,
+// after checking that no name contains characters the syntax cannot express.
+func Format(tables []Table) (string, error) {
+	defs := make([]string, len(tables))
+	for i, t := range tables {
+		if t.ID == "" || strings.ContainsAny(t.ID, ";,") {
+			return "", fmt.Errorf("invalid mtd-id %q", t.ID)
+		}
+		if len(t.Partitions) == 0 {
+			return "", fmt.Errorf("mtdparts %q: no partitions", t.ID)
+		}
+		for _, p := range t.Partitions {
+			if strings.ContainsAny(p.Name, "();") {
+				return "", fmt.Errorf("mtdparts %q: invalid partition name %q", t.ID, p.Name)
+			}
+		}
+		defs[i] = t.String()
+	}
+	return "mtdparts=" + strings.Join(defs, ";"), nil
+}
@@ -0,0 +1,176 @@
+package mtdparts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+var norInfo = unix.MtdInfo{
+	Type:      unix.MTD_NORFLASH,
+	Size:      16 << 20,
+	Erasesize: 64 << 10,
+	Writesize: 1,
+}
+
+func TestParse(t *testing.T) {
+	tables, err := Parse("mtdparts=spi0.0:256k(u-boot)ro,64k@0x40000(env),0x600000(kernel),-(rootfs)lk;nand0:1M@1M(data)slc")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := []Table{
+		{ID: "spi0.0", Partitions: []Partition{
+			{Name: "u-boot", Offset: OffsetNext, Size: 256 << 10, ReadOnly: true},
+			{Name: "env", Offset: 0x40000, Size: 64 << 10},
+			{Name: "kernel", Offset: OffsetNext, Size: 0x600000},
+			{Name: "rootfs", Offset: OffsetNext, Size: SizeRemaining, Lock: true},
+		}},
+		{ID: "nand0", Partitions: []Partition{
+			{Name: "data", Offset: 1 << 20, Size: 1 << 20, SLC: true},
+		}},
+	}
+	if !reflect.DeepEqual(tables, want) {
+		t.Fatalf("want '%+v' got '%+v'", want, tables)
+	}
+
+	parts, err := tables[0].Resolve(norInfo)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if parts[2].Offset != 0x50000 || parts[3].Offset != 0x650000 || parts[3].End() != 16<<20 {
+		t.Errorf("unexpected resolved partitions '%+v'", parts)
+	}
+
+	s, err := Format(tables)
+	if err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+	want2 := "mtdparts=spi0.0:256k(u-boot)ro,64k@256k(env),6m(kernel),-(rootfs)lk;nand0:1m@1m(data)slc"
+	if s != want2 {
+		t.Errorf("want '%v' got '%v'", want2, s)
+	}
+	again, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !reflect.DeepEqual(again, tables) {
+		t.Errorf("round trip: want '%+v' got '%+v'", tables, again)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"mtdparts=",
+		"spi0.0",
+		"spi0.0:",
+		"spi0.0:1M(a",
+		"spi0.0:1M(a),",
+		"spi0.0:1M(a)x",
+		"spi0.0:@1M(a)",
+		":1M(a)",
+	} {
+		_, err := Parse(s)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
+
+func TestResolveInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		err error
+	}{
+		{"m:1000(a)", ErrUnaligned},
+		{"m:64k@32k(a)", ErrUnaligned},
+		{"m:17M(a)", ErrOutOfBounds},
+		{"m:1M(a),1M@512k(b)", ErrOverlap},
+		{"m:-(a),1M(b)", nil},
+	} {
+		tables, err := Parse(tc.s)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tc.s, err)
+		}
+		_, err = tables[0].Resolve(norInfo)
+		if err == nil || tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("Resolve(%q): want '%v' got '%v'", tc.s, tc.err, err)
+		}
+	}
+}
+
+func TestParseFIS(t *testing.T) {
+	for _, bo := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		dir := bytes.Repeat([]byte{0xff}, int(norInfo.Erasesize))
+		for i, e := range []struct {
+			name       string
+			base, size uint32
+		}{
+			{"RedBoot", 0x50000000, 0x40000},
+			{"linux", 0x50040000, 0x200000},
+			// A deleted entry, skipped
+			{"\xffold", 0x50240000, 0x10000},
+			{fisDirectoryName, 0x50ff0000, norInfo.Erasesize},
+		} {
+			entry := dir[i*FISEntrySize : (i+1)*FISEntrySize]
+			copy(entry, make([]byte, FISEntrySize))
+			copy(entry, e.name)
+			bo.PutUint32(entry[fisNameSize:], e.base)
+			bo.PutUint32(entry[fisNameSize+8:], e.size)
+		}
+		parts, err := ReadFIS(bytes.NewReader(append(make([]byte, 16<<20-len(dir)), dir...)), norInfo, -1)
+		if err != nil {
+			t.Fatalf("ReadFIS failed: %v", err)
+		}
+		want := []Partition{
+			{Name: "RedBoot", Offset: 0, Size: 0x40000},
+			{Name: "linux", Offset: 0x40000, Size: 0x200000},
+			{Name: fisDirectoryName, Offset: 0xff0000, Size: 0x10000},
+		}
+		if !reflect.DeepEqual(parts, want) {
+			t.Errorf("want '%+v' got '%+v'", want, parts)
+		}
+		_, err = Table{ID: "fis", Partitions: parts}.Resolve(norInfo)
+		if err != nil {
+			t.Errorf("Resolve failed: %v", err)
+		}
+	}
+}
+
+func TestParseFISCombined(t *testing.T) {
+	// The directory and the RedBoot configuration share the last eraseblock,
+	// the directory taking its first half
+	for _, bo := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		dir := bytes.Repeat([]byte{0xff}, int(norInfo.Erasesize))
+		for i, e := range []struct {
+			name       string
+			base, size uint32
+		}{
+			{"RedBoot", 0x50000000, 0x40000},
+			{fisDirectoryName, 0x50ff0000, 0x8000},
+			{"RedBoot config", 0x50ff8000, 0x1000},
+		} {
+			entry := dir[i*FISEntrySize : (i+1)*FISEntrySize]
+			copy(entry, make([]byte, FISEntrySize))
+			copy(entry, e.name)
+			bo.PutUint32(entry[fisNameSize:], e.base)
+			bo.PutUint32(entry[fisNameSize+8:], e.size)
+		}
+		parts, err := ParseFIS(dir, norInfo)
+		if err != nil {
+			t.Fatalf("ParseFIS failed: %v", err)
+		}
+		want := []Partition{
+			{Name: "RedBoot", Offset: 0, Size: 0x40000},
+			{Name: fisDirectoryName, Offset: 0xff0000, Size: 0x8000},
+			{Name: "RedBoot config", Offset: 0xff8000, Size: 0x1000},
+		}
+		if !reflect.DeepEqual(parts, want) {
+			t.Errorf("want '%+v' got '%+v'", want, parts)
+		}
+	}
+}
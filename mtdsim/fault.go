@@ -0,0 +1,179 @@
+package mtdsim
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrPowerCut is returned by the operation interrupted by a simulated power
+// cut, and by every operation after it until PowerOn is called.
+var ErrPowerCut = errors.New("mtdsim: power cut")
+
+// FaultKind is the kind of a scripted fault.
+type FaultKind int
+
+const (
+	// FaultErase makes erasing the eraseblock fail with EIO.
+	FaultErase FaultKind = iota
+	// FaultProgram makes programming data or OOB in the eraseblock fail with
+	// EIO, leaving the flash unchanged.
+	FaultProgram
+	// FaultBitflips makes reads from the eraseblock return the data along
+	// with EUCLEAN, counting Fault.Bitflips corrected bitflips in the ECC
+	// statistics.
+	FaultBitflips
+	// FaultUncorrectable makes reads from the eraseblock return the data
+	// along with EBADMSG, counting an ECC failure.
+	FaultUncorrectable
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultErase:
+		return "erase"
+	case FaultProgram:
+		return "program"
+	case FaultBitflips:
+		return "bitflips"
+	case FaultUncorrectable:
+		return "uncorrectable"
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// Fault is a scripted fault, firing on the operations of its kind that touch
+// the eraseblock containing Offset.
+type Fault struct {
+	Kind   FaultKind
+	Offset int64
+	// Count is the number of operations the fault fires on before it is
+	// removed. If 0, it fires forever.
+	Count int
+	// Bitflips is the number of bitflips corrected per read, for
+	// FaultBitflips.
+	Bitflips int
+}
+
+// Inject adds a scripted fault.
+func (s *Sim) Inject(f Fault) error {
+	block, err := s.geometry.BlockAt(f.Offset)
+	if err != nil {
+		return err
+	}
+	f.Offset = block.Offset
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+	return nil
+}
+
+// ClearFaults removes all scripted faults.
+func (s *Sim) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// SetWearLimit makes each eraseblock go bad once it has been erased limit
+// times: further erases of it fail with EIO, as when a block wears out. If
+// limit is 0, blocks never wear out.
+func (s *Sim) SetWearLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wearLimit = limit
+}
+
+// EraseCount returns the number of times the eraseblock containing offset has
+// been erased successfully.
+func (s *Sim) EraseCount(offset int64) (int, error) {
+	block, err := s.geometry.BlockAt(offset)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.erases[block.Offset], nil
+}
+
+// CutPowerAfter schedules a power cut after n more bytes of data or OOB have
+// been programmed. The write in progress then leaves its last page partially
+// programmed and fails with ErrPowerCut, and so does every operation until
+// PowerOn. If n is negative, no power cut is scheduled.
+func (s *Sim) CutPowerAfter(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.powerBudget = n
+}
+
+// PowerOn restores power after a power cut, cancelling any scheduled one. The
+// flash keeps its contents, including partially programmed pages.
+func (s *Sim) PowerOn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.powerCut = false
+	s.powerBudget = -1
+}
+
+// fault returns the first fault of the given kind firing for the region of
+// length bytes at start, consuming one of its occurrences, or nil.
+func (s *Sim) fault(kind FaultKind, start, length int64) *Fault {
+	if length <= 0 {
+		return nil
+	}
+	for i, f := range s.faults {
+		if f.Kind != kind || f.Offset+int64(s.info.Erasesize) <= start || start+length <= f.Offset {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// checkProgram fails if programming the region of length bytes at start
+// must fail.
+func (s *Sim) checkProgram(start, length int64) error {
+	if s.powerCut {
+		return ErrPowerCut
+	}
+	if s.fault(FaultProgram, start, length) != nil {
+		return unix.EIO
+	}
+	return nil
+}
+
+// readFault returns the error of a read of the region of length bytes at
+// start, updating the ECC statistics.
+func (s *Sim) readFault(start, length int64) error {
+	if f := s.fault(FaultUncorrectable, start, length); f != nil {
+		s.stats.Failed++
+		return unix.EBADMSG
+	}
+	if f := s.fault(FaultBitflips, start, length); f != nil {
+		s.stats.Corrected += uint32(f.Bitflips)
+		return unix.EUCLEAN
+	}
+	return nil
+}
+
+// consumePower takes n bytes from the power budget, returning how many of
+// them can be programmed before the power is cut.
+func (s *Sim) consumePower(n int) int {
+	if s.powerBudget < 0 || int64(n) <= s.powerBudget {
+		if s.powerBudget >= 0 {
+			s.powerBudget -= int64(n)
+		}
+		return n
+	}
+	n = int(s.powerBudget)
+	s.powerBudget = -1
+	s.powerCut = true
+	return n
+}
@@ -0,0 +1,131 @@
+package mtdsim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileConfig describes a file-backed device.
+type FileConfig struct {
+	// Info holds the MTD characteristics, as for Config.
+	Info unix.MtdInfo
+	// OOBPath is the sidecar file holding the OOB areas of all pages, one
+	// after the other. If empty, the OOB areas are kept in memory and start
+	// erased.
+	OOBPath string
+	// BadBlockPath is the sidecar file listing the offsets of the bad
+	// eraseblocks, one per line, in decimal or with a 0x prefix. Blocks
+	// marked bad are appended to it. If empty, bad blocks are kept in memory.
+	BadBlockPath string
+}
+
+// OpenFile returns a device whose contents are held in the file at path,
+// e.g., a flash image being built. Missing files are created, and files
+// shorter than the device, including the sidecar OOB file, are padded with
+// erased bytes, so an image can be grown to the full device. Files larger
+// than the device are rejected. The device must be closed.
+func OpenFile(path string, cfg FileConfig) (*Sim, error) {
+	s, err := newSim(cfg.Info)
+	if err != nil {
+		return nil, err
+	}
+	err = s.openFiles(path, cfg)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openFiles opens the files backing s.
+func (s *Sim) openFiles(path string, cfg FileConfig) error {
+	data, err := s.openStore(path, int64(s.info.Size))
+	if err != nil {
+		return err
+	}
+	s.data = data
+	if cfg.OOBPath == "" {
+		s.oob = memStore(erased(s.oobSize()))
+	} else {
+		s.oob, err = s.openStore(cfg.OOBPath, s.oobSize())
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.BadBlockPath != "" {
+		err = s.openBadBlocks(cfg.BadBlockPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openStore opens the file at path holding size bytes, padding it with
+// erased bytes if needed.
+func (s *Sim) openStore(path string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.files = append(s.files, f)
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > size {
+		return nil, fmt.Errorf("mtdsim: '%v' is larger than the device: 0x%x > 0x%x", path, fi.Size(), size)
+	}
+	if fi.Size() < size {
+		err = fill(f, fi.Size(), size-fi.Size(), 0xff)
+		if err != nil {
+			return nil, fmt.Errorf("mtdsim: padding '%v': %w", path, err)
+		}
+	}
+	return f, nil
+}
+
+// openBadBlocks reads the bad-block file at path and keeps it open for
+// appending.
+func (s *Sim) openBadBlocks(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		offset, err := strconv.ParseInt(text, 0, 64)
+		if err != nil {
+			return fmt.Errorf("mtdsim: '%v' line %v: %w", path, line, err)
+		}
+		block, err := s.geometry.BlockAt(offset)
+		if err != nil {
+			return fmt.Errorf("mtdsim: '%v' line %v: %w", path, line, err)
+		}
+		if !s.bad[block.Offset] {
+			s.bad[block.Offset] = true
+			s.stats.Badblocks++
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	s.badFile = f
+	return nil
+}
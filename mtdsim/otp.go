@@ -0,0 +1,94 @@
+package mtdsim
+
+import (
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// OTPRegions returns the regions of the OTP area of the given kind. Like the
+// kernel, it fails with EOPNOTSUPP if the simulated device has no such area.
+func (s *Sim) OTPRegions(kind mtdabi.OTPKind) ([]mtdabi.OTPRegion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.otpRegions(kind)
+}
+
+// ReadOTP reads the whole OTP area of the given kind.
+func (s *Sim) ReadOTP(kind mtdabi.OTPKind) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.otpRegions(kind)
+	if err != nil {
+		return nil, err
+	}
+	if kind == mtdabi.OTPFactory {
+		return append([]byte(nil), s.factoryOTP...), nil
+	}
+	return append([]byte(nil), s.userOTP...), nil
+}
+
+// WriteOTP programs data into the user OTP area at offset. Like SPI-NOR
+// flash, it fails with EROFS if any of the regions written is locked.
+func (s *Sim) WriteOTP(offset int64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	regions, err := s.otpRegions(mtdabi.OTPUser)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset+int64(len(data)) > int64(len(s.userOTP)) {
+		return unix.EINVAL
+	}
+	for _, r := range regions {
+		if r.Locked && offset < r.End() && r.Start < offset+int64(len(data)) {
+			return unix.EROFS
+		}
+	}
+	return program(memStore(s.userOTP), offset, data)
+}
+
+// LockOTP permanently locks the region of length bytes at offset of the user
+// OTP area. Like SPI-NOR flash, the range must cover whole regions.
+func (s *Sim) LockOTP(offset, length int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.otpRegions(mtdabi.OTPUser)
+	if err != nil {
+		return err
+	}
+	end := offset + length
+	covered := false
+	for _, r := range s.userRegions {
+		overlaps := offset < r.End() && r.Start < end
+		if overlaps && (r.Start < offset || r.End() > end) {
+			return unix.EINVAL
+		}
+		covered = covered || overlaps
+	}
+	if !covered {
+		return unix.EINVAL
+	}
+	for i, r := range s.userRegions {
+		if offset <= r.Start && r.End() <= end {
+			s.userRegions[i].Locked = true
+		}
+	}
+	return nil
+}
+
+// otpRegions returns the regions of the OTP area of the given kind.
+func (s *Sim) otpRegions(kind mtdabi.OTPKind) ([]mtdabi.OTPRegion, error) {
+	switch kind {
+	case mtdabi.OTPFactory:
+		if len(s.factoryOTP) == 0 {
+			return nil, unix.EOPNOTSUPP
+		}
+		return []mtdabi.OTPRegion{{Start: 0, Length: int64(len(s.factoryOTP)), Locked: true}}, nil
+	case mtdabi.OTPUser:
+		if len(s.userRegions) == 0 {
+			return nil, unix.EOPNOTSUPP
+		}
+		return append([]mtdabi.OTPRegion(nil), s.userRegions...), nil
+	}
+	return nil, unix.EINVAL
+}
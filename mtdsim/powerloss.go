@@ -0,0 +1,246 @@
+package mtdsim
+
+import (
+	"fmt"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// OpKind is the kind of a recorded operation.
+type OpKind int
+
+const (
+	// OpProgram programs in-band data.
+	OpProgram OpKind = iota
+	// OpProgramOOB programs out-of-band data.
+	OpProgramOOB
+	// OpErase erases an eraseblock, including its OOB areas.
+	OpErase
+	// OpMarkBad marks an eraseblock bad.
+	OpMarkBad
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpProgram:
+		return "program"
+	case OpProgramOOB:
+		return "program OOB"
+	case OpErase:
+		return "erase"
+	case OpMarkBad:
+		return "mark bad"
+	}
+	return fmt.Sprintf("OpKind(%d)", int(k))
+}
+
+// Op is a recorded operation that changed the flash. Erases of several
+// eraseblocks are recorded block by block, and writes interrupted by a power
+// cut with the bytes actually programmed.
+type Op struct {
+	Kind OpKind
+	// Offset is the offset in the flash, or for OpProgramOOB the offset in
+	// the OOB areas of all pages laid end to end.
+	Offset int64
+	Length int64
+	// Data holds the bytes programmed.
+	Data []byte
+}
+
+func (op Op) String() string {
+	return fmt.Sprintf("%v 0x%x+0x%x", op.Kind, op.Offset, op.Length)
+}
+
+// Recording holds the state of a device when recording started and the
+// operations applied to it since.
+type Recording struct {
+	Ops []Op
+
+	initial *Sim
+}
+
+// StartRecording snapshots the device and starts recording the operations
+// changing it, replacing any recording in progress.
+func (s *Sim) StartRecording() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	initial, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	s.recording = &Recording{initial: initial}
+	return nil
+}
+
+// StopRecording stops recording and returns the recording, or nil if none
+// was in progress.
+func (s *Sim) StopRecording() *Recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.recording
+	s.recording = nil
+	return r
+}
+
+// record appends op to the recording in progress, if any.
+func (s *Sim) record(op Op) {
+	if s.recording != nil {
+		s.recording.Ops = append(s.recording.Ops, op)
+	}
+}
+
+// Snapshot returns an in-memory copy of the device, with the same contents,
+// bad blocks, erase counts and OTP areas, but without faults or recording.
+func (s *Sim) Snapshot() (*Sim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+func (s *Sim) snapshot() (*Sim, error) {
+	c, err := newSim(s.info)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, s.info.Size)
+	_, err = s.data.ReadAt(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	oob := make([]byte, s.oobSize())
+	_, err = s.oob.ReadAt(oob, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.data, c.oob = memStore(data), memStore(oob)
+	c.stats = s.stats
+	for block := range s.bad {
+		c.bad[block] = true
+	}
+	for block, count := range s.erases {
+		c.erases[block] = count
+	}
+	c.factoryOTP = append([]byte(nil), s.factoryOTP...)
+	c.userOTP = append([]byte(nil), s.userOTP...)
+	c.userRegions = append([]mtdabi.OTPRegion(nil), s.userRegions...)
+	return c, nil
+}
+
+// Replay returns an in-memory device in the state left by a power loss after
+// the first n operations of the recording. If torn is set, the power is lost
+// halfway through operation n instead: the first half of its bytes are
+// programmed or erased.
+func (r *Recording) Replay(n int, torn bool) (*Sim, error) {
+	if n < 0 || n > len(r.Ops) || torn && n == len(r.Ops) {
+		return nil, fmt.Errorf("mtdsim: replay of %v operations out of %v", n, len(r.Ops))
+	}
+	s, err := r.initial.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range r.Ops[:n] {
+		err = s.apply(op, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if torn {
+		err = s.apply(r.Ops[n], true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// apply applies op, or if torn, the first half of its bytes. Marking bad is
+// not divisible and not applied if torn.
+func (s *Sim) apply(op Op, torn bool) error {
+	length := op.Length
+	if torn {
+		length /= 2
+	}
+	switch op.Kind {
+	case OpProgram:
+		return program(s.data, op.Offset, op.Data[:length])
+	case OpProgramOOB:
+		return program(s.oob, op.Offset, op.Data[:length])
+	case OpErase:
+		err := fill(s.data, op.Offset, length, 0xff)
+		if err != nil || length < op.Length {
+			return err
+		}
+		s.erases[op.Offset]++
+		return fill(s.oob, s.oobOffset(op.Offset), s.oobOffset(op.Offset+op.Length)-s.oobOffset(op.Offset), 0xff)
+	case OpMarkBad:
+		if torn {
+			return nil
+		}
+		return s.setBad(op.Offset)
+	}
+	return fmt.Errorf("mtdsim: unknown operation %v", op.Kind)
+}
+
+// PowerLossFailure is a power loss point after which the consistency check
+// failed.
+type PowerLossFailure struct {
+	// Ops is the number of operations completed before the power loss.
+	Ops int
+	// Op is the operation interrupted, if torn.
+	Op  *Op
+	Err error
+}
+
+func (f *PowerLossFailure) Error() string {
+	if f.Op != nil {
+		return fmt.Sprintf("power loss after %v operations, during %v: %v", f.Ops, f.Op, f.Err)
+	}
+	return fmt.Sprintf("power loss after %v operations: %v", f.Ops, f.Err)
+}
+
+func (f *PowerLossFailure) Unwrap() error {
+	return f.Err
+}
+
+// CheckPowerLoss runs workload on a copy of base while recording its
+// operations, then simulates a power loss before and after every operation:
+// for each point, check runs on a fresh device in the state the power loss
+// leaves. If torn is set, power losses in the middle of every operation are
+// simulated too. It returns the points at which check failed; it only fails
+// itself if the workload does.
+func CheckPowerLoss(base *Sim, workload, check func(mtdabi.Flash) error, torn bool) ([]*PowerLossFailure, error) {
+	s, err := base.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	err = s.StartRecording()
+	if err != nil {
+		return nil, err
+	}
+	err = workload(s)
+	if err != nil {
+		return nil, fmt.Errorf("mtdsim: workload failed: %w", err)
+	}
+	r := s.StopRecording()
+	var failures []*PowerLossFailure
+	for n := 0; n <= len(r.Ops); n++ {
+		for _, t := range []bool{false, true} {
+			if t && (!torn || n == len(r.Ops)) {
+				continue
+			}
+			after, err := r.Replay(n, t)
+			if err != nil {
+				return nil, err
+			}
+			err = check(after)
+			if err != nil {
+				f := &PowerLossFailure{Ops: n, Err: err}
+				if t {
+					f.Op = &r.Ops[n]
+				}
+				failures = append(failures, f)
+			}
+		}
+	}
+	return failures, nil
+}
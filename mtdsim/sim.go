@@ -0,0 +1,434 @@
+// Package mtdsim simulates an MTD device in memory or on top of image files,
+// for testing and building images with code written against mtdabi.Flash
+// without a real (or nandsim) flash.
+//
+// The simulation follows NAND semantics: erased bytes read as 0xFF, programming
+// can only clear bits (the new contents are the AND of the old contents and the
+// data written), each page has a separate OOB area, and bad eraseblocks cannot
+// be erased. Arguments are checked with the same pre-flight validation as
+// mtdabi.Device.
+package mtdsim
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// Config describes the simulated device.
+type Config struct {
+	// Info holds the MTD characteristics. Size must be a multiple of
+	// Erasesize, which must be a multiple of Writesize.
+	Info unix.MtdInfo
+	// FactoryOTP holds the contents of the factory OTP area, which is a
+	// single locked region. It may be empty.
+	FactoryOTP []byte
+	// UserOTP holds the lengths of the regions of the user OTP area, which
+	// start erased and unlocked. It may be empty.
+	UserOTP []int64
+	// BadBlocks holds the offsets of the eraseblocks that are initially bad.
+	BadBlocks []int64
+}
+
+// Sim is a simulated MTD device. It is safe for concurrent use.
+type Sim struct {
+	mu       sync.Mutex
+	info     unix.MtdInfo
+	geometry *mtdabi.Geometry
+	data     store
+	oob      store
+	bad      map[int64]bool
+	// badFile records the eraseblocks marked bad, if file-backed
+	badFile *os.File
+	files   []*os.File
+	stats   unix.MtdEccStats
+
+	faults      []*Fault
+	wearLimit   int
+	erases      map[int64]int
+	powerBudget int64
+	powerCut    bool
+	recording   *Recording
+
+	factoryOTP  []byte
+	userOTP     []byte
+	userRegions []mtdabi.OTPRegion
+}
+
+var _ mtdabi.Flash = (*Sim)(nil)
+
+// store holds the contents of the flash or of its OOB areas.
+type store interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// memStore is a store in memory.
+type memStore []byte
+
+func (m memStore) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, m[off:]), nil
+}
+
+func (m memStore) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m[off:], p), nil
+}
+
+// New returns a simulated device described by cfg, fully erased and held in
+// memory.
+func New(cfg Config) (*Sim, error) {
+	s, err := newSim(cfg.Info)
+	if err != nil {
+		return nil, err
+	}
+	s.data = memStore(erased(int64(cfg.Info.Size)))
+	s.oob = memStore(erased(s.oobSize()))
+	s.factoryOTP = append([]byte(nil), cfg.FactoryOTP...)
+	start := int64(0)
+	for _, length := range cfg.UserOTP {
+		s.userRegions = append(s.userRegions, mtdabi.OTPRegion{Start: start, Length: length})
+		start += length
+	}
+	s.userOTP = erased(start)
+	for _, offset := range cfg.BadBlocks {
+		err = s.setBad(offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SmallNAND describes a small NAND flash of four 16 KiB eraseblocks of
+// 512-byte pages with 16-byte OOB areas, enough for most tests.
+var SmallNAND = unix.MtdInfo{
+	Type:      unix.MTD_NANDFLASH,
+	Flags:     unix.MTD_CAP_NANDFLASH,
+	Size:      0x10000,
+	Erasesize: 0x4000,
+	Writesize: 0x200,
+	Oobsize:   0x10,
+}
+
+// NewSmallNAND returns a simulated SmallNAND device in memory with the given
+// bad eraseblocks. It panics if a bad eraseblock is out of range.
+func NewSmallNAND(badBlocks ...int64) *Sim {
+	s, err := New(Config{Info: SmallNAND, BadBlocks: badBlocks})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// newSim returns a simulated device described by info, without storage.
+func newSim(info unix.MtdInfo) (*Sim, error) {
+	if info.Writesize == 0 || info.Erasesize%info.Writesize != 0 {
+		return nil, fmt.Errorf("mtdsim: erase size 0x%x is not a multiple of write size 0x%x",
+			info.Erasesize, info.Writesize)
+	}
+	if info.Erasesize == 0 || info.Size%info.Erasesize != 0 {
+		return nil, fmt.Errorf("mtdsim: size 0x%x is not a multiple of erase size 0x%x",
+			info.Size, info.Erasesize)
+	}
+	geometry, err := mtdabi.NewGeometry(info, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Sim{
+		info:        info,
+		geometry:    geometry,
+		bad:         make(map[int64]bool),
+		erases:      make(map[int64]int),
+		powerBudget: -1,
+	}, nil
+}
+
+// Close closes the files backing the device, if any.
+func (s *Sim) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, f := range s.files {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	s.files = nil
+	return err
+}
+
+// Info returns the MTD characteristics of the simulated device.
+func (s *Sim) Info() unix.MtdInfo {
+	return s.info
+}
+
+// Geometry returns the eraseblock layout of the simulated device.
+func (s *Sim) Geometry() *mtdabi.Geometry {
+	return s.geometry
+}
+
+// ReadAt reads len(p) bytes of in-band data starting at offset off. Like the
+// MTD read path in the kernel, it returns the data read along with EUCLEAN if
+// bitflips were corrected, or EBADMSG if they could not be; see Inject.
+func (s *Sim) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.powerCut {
+		return 0, ErrPowerCut
+	}
+	if off < 0 {
+		return 0, unix.EINVAL
+	}
+	size := int64(s.info.Size)
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+	n, err := s.data.ReadAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	err = s.readFault(off, int64(n))
+	if err != nil {
+		return n, err
+	}
+	return n, eof
+}
+
+// WriteAt programs len(p) bytes of in-band data starting at offset off.
+func (s *Sim) WriteAt(p []byte, off int64) (int, error) {
+	err := mtdabi.CheckWrite(s.info, off, len(p), 0)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.checkProgram(off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return s.programPowered(OpProgram, off, p)
+}
+
+// Erase erases length bytes starting at start, including the OOB areas of the
+// pages erased. Eraseblocks are erased in order; like NAND flash, it stops
+// with EIO at the first block that is bad, worn out or failing.
+func (s *Sim) Erase(start, length int64) error {
+	err := s.geometry.CheckErase(start, length)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.powerCut {
+		return ErrPowerCut
+	}
+	erasesize := int64(s.info.Erasesize)
+	for block := start; block < start+length; block += erasesize {
+		worn := s.wearLimit > 0 && s.erases[block] >= s.wearLimit
+		if s.bad[block] || worn || s.fault(FaultErase, block, erasesize) != nil {
+			return unix.EIO
+		}
+		err = fill(s.data, block, erasesize, 0xff)
+		if err != nil {
+			return err
+		}
+		err = fill(s.oob, s.oobOffset(block), s.oobOffset(block+erasesize)-s.oobOffset(block), 0xff)
+		if err != nil {
+			return err
+		}
+		s.erases[block]++
+		s.record(Op{Kind: OpErase, Offset: block, Length: erasesize})
+	}
+	return nil
+}
+
+// ReadOOB reads len(buf) bytes of out-of-band data of the page containing
+// offset into buf.
+func (s *Sim) ReadOOB(offset int64, buf []byte) error {
+	err := mtdabi.CheckOOB(s.info, offset, len(buf))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.powerCut {
+		return ErrPowerCut
+	}
+	_, err = s.oob.ReadAt(buf, s.oobOffset(offset)+offset%int64(s.info.Writesize))
+	return err
+}
+
+// WriteOOB programs buf into the out-of-band area of the page containing
+// offset.
+func (s *Sim) WriteOOB(offset int64, buf []byte) error {
+	err := mtdabi.CheckOOB(s.info, offset, len(buf))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.checkProgram(offset, int64(len(buf)))
+	if err != nil {
+		return err
+	}
+	_, err = s.programPowered(OpProgramOOB, s.oobOffset(offset)+offset%int64(s.info.Writesize), buf)
+	return err
+}
+
+// Write programs in-band data and/or out-of-band data starting at offset, as
+// with MEMWRITE. The OOB data is laid out page by page; mode is accepted for
+// compatibility with mtdabi.Device.Write and does not change the layout.
+func (s *Sim) Write(offset int64, data, oob []byte, mode uint8) error {
+	if len(data) == 0 && len(oob) == 0 {
+		return fmt.Errorf("write at 0x%x: no data or OOB given", offset)
+	}
+	err := mtdabi.CheckWrite(s.info, offset, len(data), len(oob))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// OOB-only writes touch the page at offset
+	length := int64(len(data))
+	if length == 0 {
+		length = 1
+	}
+	err = s.checkProgram(offset, length)
+	if err != nil {
+		return err
+	}
+	_, err = s.programPowered(OpProgram, offset, data)
+	if err != nil {
+		return err
+	}
+	_, err = s.programPowered(OpProgramOOB, s.oobOffset(offset), oob)
+	return err
+}
+
+// IsBad reports whether the eraseblock containing offset is bad.
+func (s *Sim) IsBad(offset int64) (bool, error) {
+	block, err := s.geometry.BlockAt(offset)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bad[block.Offset], nil
+}
+
+// MarkBad marks the eraseblock containing offset as bad. If the device is
+// file-backed with a bad-block file, the block is recorded there.
+func (s *Sim) MarkBad(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setBad(offset)
+}
+
+// setBad marks the eraseblock containing offset as bad.
+func (s *Sim) setBad(offset int64) error {
+	block, err := s.geometry.BlockAt(offset)
+	if err != nil {
+		return err
+	}
+	if s.bad[block.Offset] {
+		return nil
+	}
+	if s.badFile != nil {
+		_, err = fmt.Fprintf(s.badFile, "0x%x\n", block.Offset)
+		if err != nil {
+			return err
+		}
+	}
+	s.bad[block.Offset] = true
+	s.stats.Badblocks++
+	s.record(Op{Kind: OpMarkBad, Offset: block.Offset})
+	return nil
+}
+
+// ECCStats returns the counts of corrected and uncorrectable ECC errors
+// reported by reads, and the number of bad blocks.
+func (s *Sim) ECCStats() (unix.MtdEccStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats, nil
+}
+
+// programPowered programs p at off of the data (OpProgram) or OOB
+// (OpProgramOOB) store, unless the power is cut first. It returns the number
+// of bytes programmed.
+func (s *Sim) programPowered(kind OpKind, off int64, p []byte) (int, error) {
+	n := s.consumePower(len(p))
+	st := s.data
+	if kind == OpProgramOOB {
+		st = s.oob
+	}
+	err := program(st, off, p[:n])
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.record(Op{Kind: kind, Offset: off, Length: int64(n), Data: append([]byte(nil), p[:n]...)})
+	}
+	if n < len(p) {
+		return n, ErrPowerCut
+	}
+	return n, nil
+}
+
+// oobOffset returns the offset in s.oob of the OOB area of the page containing
+// offset.
+func (s *Sim) oobOffset(offset int64) int64 {
+	return offset / int64(s.info.Writesize) * int64(s.info.Oobsize)
+}
+
+// oobSize returns the size of all OOB areas.
+func (s *Sim) oobSize() int64 {
+	return int64(s.info.Size/s.info.Writesize) * int64(s.info.Oobsize)
+}
+
+// erased returns size bytes of erased flash.
+func erased(size int64) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	return buf
+}
+
+// fill sets length bytes of st at off to v.
+func fill(st store, off, length int64, v byte) error {
+	buf := make([]byte, length)
+	for i := range buf {
+		buf[i] = v
+	}
+	_, err := st.WriteAt(buf, off)
+	return err
+}
+
+// program programs p into st at off. As on flash, programming can only clear
+// bits.
+func program(st store, off int64, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	buf := make([]byte, len(p))
+	_, err := st.ReadAt(buf, off)
+	if err != nil {
+		return err
+	}
+	for i, v := range p {
+		buf[i] &= v
+	}
+	_, err = st.WriteAt(buf, off)
+	return err
+}
@@ -0,0 +1,468 @@
+package mtdsim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+func TestProgramAndErase(t *testing.T) {
+	sim := NewSmallNAND()
+
+	page := bytes.Repeat([]byte{0x0f}, int(SmallNAND.Writesize))
+	_, err := sim.WriteAt(page, int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	// Programming only clears bits
+	_, err = sim.WriteAt(bytes.Repeat([]byte{0xf5}, int(SmallNAND.Writesize)), int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, SmallNAND.Writesize)
+	_, err = sim.ReadAt(got, int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if want := bytes.Repeat([]byte{0x05}, int(SmallNAND.Writesize)); !bytes.Equal(want, got) {
+		t.Errorf("Data: want '%v' got '%v'", want, got)
+	}
+
+	oob := []byte{1, 2, 3, 4}
+	err = sim.WriteOOB(int64(SmallNAND.Erasesize)+4, oob)
+	if err != nil {
+		t.Fatalf("WriteOOB failed: %v", err)
+	}
+	gotOob := make([]byte, SmallNAND.Oobsize)
+	err = sim.ReadOOB(int64(SmallNAND.Erasesize), gotOob)
+	if err != nil {
+		t.Fatalf("ReadOOB failed: %v", err)
+	}
+	wantOob := []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if !bytes.Equal(wantOob, gotOob) {
+		t.Errorf("Oob: want '%v' got '%v'", wantOob, gotOob)
+	}
+
+	err = sim.Erase(int64(SmallNAND.Erasesize), int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("Erase failed: %v", err)
+	}
+	_, err = sim.ReadAt(got, int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	err = sim.ReadOOB(int64(SmallNAND.Erasesize), gotOob)
+	if err != nil {
+		t.Fatalf("ReadOOB failed: %v", err)
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte{0xff}, len(got))) || !bytes.Equal(gotOob, bytes.Repeat([]byte{0xff}, len(gotOob))) {
+		t.Errorf("Erase did not erase data and OOB")
+	}
+
+	err = sim.Erase(1, int64(SmallNAND.Erasesize))
+	if !errors.Is(err, mtdabi.ErrUnaligned) {
+		t.Errorf("Erase err: want '%v' got '%v'", mtdabi.ErrUnaligned, err)
+	}
+}
+
+func TestOTP(t *testing.T) {
+	sim, err := New(Config{Info: SmallNAND, FactoryOTP: []byte("factory"), UserOTP: []int64{16, 16}})
+	if err != nil {
+		t.Fatalf("Failed to create simulated MTD: %v", err)
+	}
+	got, err := sim.ReadOTP(mtdabi.OTPFactory)
+	if err != nil {
+		t.Fatalf("ReadOTP failed: %v", err)
+	}
+	if string(got) != "factory" {
+		t.Errorf("Factory OTP: want '%v' got '%v'", "factory", string(got))
+	}
+	err = sim.LockOTP(8, 16)
+	if err != unix.EINVAL {
+		t.Errorf("LockOTP err: want '%v' got '%v'", unix.EINVAL, err)
+	}
+
+	sim = NewSmallNAND()
+	_, err = sim.OTPRegions(mtdabi.OTPUser)
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("OTPRegions err: want '%v' got '%v'", unix.EOPNOTSUPP, err)
+	}
+}
+
+func TestBadBlocks(t *testing.T) {
+	sim, err := New(Config{Info: SmallNAND, BadBlocks: []int64{int64(SmallNAND.Erasesize) + 1}})
+	if err != nil {
+		t.Fatalf("Failed to create simulated MTD: %v", err)
+	}
+	bad, err := sim.IsBad(int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("IsBad failed: %v", err)
+	}
+	if !bad {
+		t.Errorf("Eraseblock 1 is not bad")
+	}
+	err = sim.Erase(0, int64(SmallNAND.Size))
+	if err != unix.EIO {
+		t.Errorf("Erase err: want '%v' got '%v'", unix.EIO, err)
+	}
+	err = sim.MarkBad(int64(SmallNAND.Size))
+	if !errors.Is(err, mtdabi.ErrOutOfBounds) {
+		t.Errorf("MarkBad err: want '%v' got '%v'", mtdabi.ErrOutOfBounds, err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtdsim")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flash.img")
+	cfg := FileConfig{
+		Info:         SmallNAND,
+		OOBPath:      path + ".oob",
+		BadBlockPath: path + ".bb",
+	}
+
+	// A short image is padded with erased bytes
+	err = ioutil.WriteFile(path, []byte("image"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	sim, err := OpenFile(path, cfg)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	page := bytes.Repeat([]byte{0x5a}, int(SmallNAND.Writesize))
+	err = sim.Write(int64(SmallNAND.Writesize), page, []byte{0, 1}, unix.MTD_OPS_AUTO_OOB)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Programming only clears bits
+	_, err = sim.WriteAt(bytes.Repeat([]byte{0x0f}, int(SmallNAND.Writesize)), int64(SmallNAND.Writesize))
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	err = sim.MarkBad(3 * int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("MarkBad failed: %v", err)
+	}
+	err = sim.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	img, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if len(img) != int(SmallNAND.Size) || string(img[:5]) != "image" || img[5] != 0xff {
+		t.Errorf("Image not padded: %v bytes starting with '%q'", len(img), img[:6])
+	}
+	if want := bytes.Repeat([]byte{0x0a}, int(SmallNAND.Writesize)); !bytes.Equal(img[SmallNAND.Writesize:2*SmallNAND.Writesize], want) {
+		t.Errorf("Page not AND-programmed")
+	}
+	oob, err := ioutil.ReadFile(cfg.OOBPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if int64(len(oob)) != int64(SmallNAND.Size/SmallNAND.Writesize*SmallNAND.Oobsize) ||
+		oob[SmallNAND.Oobsize] != 0 || oob[SmallNAND.Oobsize+1] != 1 || oob[0] != 0xff {
+		t.Errorf("Unexpected OOB file contents")
+	}
+
+	// The bad-block file persists
+	sim, err = OpenFile(path, cfg)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer sim.Close()
+	bad, err := sim.IsBad(3*int64(SmallNAND.Erasesize) + 1)
+	if err != nil {
+		t.Fatalf("IsBad failed: %v", err)
+	}
+	if !bad {
+		t.Errorf("Eraseblock 3 is not bad after reopening")
+	}
+	err = sim.Erase(0, int64(SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("Erase failed: %v", err)
+	}
+	got := make([]byte, 5)
+	_, err = sim.ReadAt(got, 0)
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte{0xff}, 5)) {
+		t.Errorf("Erase did not erase the image")
+	}
+}
+
+// eraseOrRetire erases the eraseblock at offset, marking it bad if the erase
+// fails, as flash translation layers do.
+func eraseOrRetire(f mtdabi.Flash, offset int64) (bool, error) {
+	err := f.Erase(offset, int64(f.Info().Erasesize))
+	if err == unix.EIO {
+		return false, f.MarkBad(offset)
+	}
+	return err == nil, err
+}
+
+func TestFaults(t *testing.T) {
+	sim := NewSmallNAND()
+	erasesize := int64(SmallNAND.Erasesize)
+	page := bytes.Repeat([]byte{0}, int(SmallNAND.Writesize))
+
+	err := sim.Inject(Fault{Kind: FaultErase, Offset: erasesize + 1, Count: 1})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	ok, err := eraseOrRetire(sim, erasesize)
+	if err != nil || ok {
+		t.Fatalf("eraseOrRetire: want 'false, <nil>' got '%v, %v'", ok, err)
+	}
+	if bad, _ := sim.IsBad(erasesize); !bad {
+		t.Errorf("Failing eraseblock was not retired")
+	}
+	stats, _ := sim.ECCStats()
+	if stats.Badblocks != 1 {
+		t.Errorf("Badblocks: want '1' got '%v'", stats.Badblocks)
+	}
+
+	err = sim.Inject(Fault{Kind: FaultProgram, Offset: 0, Count: 1})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	_, err = sim.WriteAt(page, 0)
+	if err != unix.EIO {
+		t.Errorf("WriteAt err: want '%v' got '%v'", unix.EIO, err)
+	}
+	// The fault fired once
+	_, err = sim.WriteAt(page, 0)
+	if err != nil {
+		t.Errorf("WriteAt failed: %v", err)
+	}
+
+	err = sim.Inject(Fault{Kind: FaultBitflips, Offset: 0, Bitflips: 3})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	got := make([]byte, len(page))
+	n, err := sim.ReadAt(got, 0)
+	if err != unix.EUCLEAN || n != len(got) || !bytes.Equal(got, page) {
+		t.Errorf("ReadAt: want '%v, %v' with data got '%v, %v'", len(got), unix.EUCLEAN, n, err)
+	}
+	// Reads from other eraseblocks are not affected
+	_, err = sim.ReadAt(got, 2*erasesize)
+	if err != nil {
+		t.Errorf("ReadAt failed: %v", err)
+	}
+	sim.ClearFaults()
+	err = sim.Inject(Fault{Kind: FaultUncorrectable, Offset: 0})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	_, err = sim.ReadAt(got, 0)
+	if err != unix.EBADMSG {
+		t.Errorf("ReadAt err: want '%v' got '%v'", unix.EBADMSG, err)
+	}
+	stats, _ = sim.ECCStats()
+	if stats.Corrected != 3 || stats.Failed != 1 {
+		t.Errorf("ECC stats: want '3 corrected, 1 failed' got '%+v'", stats)
+	}
+	sim.ClearFaults()
+
+	sim.SetWearLimit(2)
+	for i := 0; i < 2; i++ {
+		err = sim.Erase(2*erasesize, erasesize)
+		if err != nil {
+			t.Fatalf("Erase failed: %v", err)
+		}
+	}
+	err = sim.Erase(2*erasesize, erasesize)
+	if err != unix.EIO {
+		t.Errorf("Erase of worn block err: want '%v' got '%v'", unix.EIO, err)
+	}
+	count, _ := sim.EraseCount(2 * erasesize)
+	if count != 2 {
+		t.Errorf("EraseCount: want '2' got '%v'", count)
+	}
+}
+
+func TestPowerCut(t *testing.T) {
+	sim := NewSmallNAND()
+	writesize := int(SmallNAND.Writesize)
+
+	sim.CutPowerAfter(int64(writesize) + 100)
+	n, err := sim.WriteAt(make([]byte, 2*writesize), 0)
+	if err != ErrPowerCut || n != writesize+100 {
+		t.Fatalf("WriteAt: want '%v, %v' got '%v, %v'", writesize+100, ErrPowerCut, n, err)
+	}
+	_, err = sim.ReadAt(make([]byte, 1), 0)
+	if err != ErrPowerCut {
+		t.Errorf("ReadAt while powered off err: want '%v' got '%v'", ErrPowerCut, err)
+	}
+	err = sim.Erase(0, int64(SmallNAND.Erasesize))
+	if err != ErrPowerCut {
+		t.Errorf("Erase while powered off err: want '%v' got '%v'", ErrPowerCut, err)
+	}
+
+	sim.PowerOn()
+	got := make([]byte, writesize)
+	_, err = sim.ReadAt(got, int64(writesize))
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	// The second page is partially programmed
+	want := append(make([]byte, 100), bytes.Repeat([]byte{0xff}, writesize-100)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Partial page: want '%v' got '%v'", want, got)
+	}
+}
+
+// writeRecord programs a record made of a sequence number, the payload and
+// its CRC at offset.
+func writeRecord(f mtdabi.Flash, offset int64, seq byte, payload string) error {
+	page := bytes.Repeat([]byte{0xff}, int(f.Info().Writesize))
+	page[0] = seq
+	n := copy(page[1:], payload)
+	binary.BigEndian.PutUint32(page[1+n:], crc32.ChecksumIEEE(page[:1+n]))
+	_, err := f.WriteAt(page, offset)
+	return err
+}
+
+// readRecord returns the record at offset, or false if there is no valid one.
+func readRecord(f mtdabi.Flash, offset int64, size int) (byte, string, bool) {
+	page := make([]byte, f.Info().Writesize)
+	_, err := f.ReadAt(page, offset)
+	if err != nil {
+		return 0, "", false
+	}
+	if crc32.ChecksumIEEE(page[:1+size]) != binary.BigEndian.Uint32(page[1+size:]) {
+		return 0, "", false
+	}
+	return page[0], string(page[1 : 1+size]), true
+}
+
+func TestCheckPowerLoss(t *testing.T) {
+	base := NewSmallNAND()
+	erasesize := int64(SmallNAND.Erasesize)
+	err := writeRecord(base, 0, 1, "old")
+	if err != nil {
+		t.Fatalf("writeRecord failed: %v", err)
+	}
+	// The old or the new record must survive
+	check := func(f mtdabi.Flash) error {
+		for _, offset := range []int64{0, erasesize} {
+			_, payload, ok := readRecord(f, offset, 3)
+			if ok && (payload == "old" || payload == "new") {
+				return nil
+			}
+		}
+		return errors.New("no valid record")
+	}
+
+	// Updating in place loses the record if the power is lost between the
+	// erase and the write
+	inPlace := func(f mtdabi.Flash) error {
+		err := f.Erase(0, erasesize)
+		if err != nil {
+			return err
+		}
+		return writeRecord(f, 0, 2, "new")
+	}
+	failures, err := CheckPowerLoss(base, inPlace, check, true)
+	if err != nil {
+		t.Fatalf("CheckPowerLoss failed: %v", err)
+	}
+	// During and after the erase; the torn write programs the whole record,
+	// which fits in the first half of the page
+	if len(failures) != 2 || failures[0].Ops != 0 || failures[0].Op == nil || failures[0].Op.Kind != OpErase {
+		t.Errorf("In-place update: unexpected failures %v", failures)
+	}
+
+	// Writing the new copy elsewhere before erasing the old one is safe
+	twoCopies := func(f mtdabi.Flash) error {
+		err := writeRecord(f, erasesize, 2, "new")
+		if err != nil {
+			return err
+		}
+		return f.Erase(0, erasesize)
+	}
+	failures, err = CheckPowerLoss(base, twoCopies, check, true)
+	if err != nil {
+		t.Fatalf("CheckPowerLoss failed: %v", err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("Two-copy update: unexpected failures %v", failures)
+	}
+
+	// The base device is not modified
+	_, payload, ok := readRecord(base, 0, 3)
+	if !ok || payload != "old" {
+		t.Errorf("Base device modified")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	sim := NewSmallNAND()
+	erasesize := int64(SmallNAND.Erasesize)
+	err := sim.StartRecording()
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	_, err = sim.WriteAt(make([]byte, SmallNAND.Writesize), 0)
+	if err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	err = sim.MarkBad(erasesize)
+	if err != nil {
+		t.Fatalf("MarkBad failed: %v", err)
+	}
+	rec := sim.StopRecording()
+	if len(rec.Ops) != 2 || rec.Ops[1].Kind != OpMarkBad {
+		t.Fatalf("Unexpected operations %v", rec.Ops)
+	}
+
+	// Half of the page is programmed
+	s, err := rec.Replay(0, true)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	page := make([]byte, SmallNAND.Writesize)
+	_, err = s.ReadAt(page, 0)
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	half := len(page) / 2
+	if !bytes.Equal(page[:half], make([]byte, half)) || !bytes.Equal(page[half:], bytes.Repeat([]byte{0xff}, half)) {
+		t.Errorf("Torn program: got '%v'", page)
+	}
+
+	// Marking bad is either done or not
+	for _, torn := range []bool{true, false} {
+		n := 1
+		if !torn {
+			n = 2
+		}
+		s, err = rec.Replay(n, torn)
+		if err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		bad, err := s.IsBad(erasesize)
+		if err != nil {
+			t.Fatalf("IsBad failed: %v", err)
+		}
+		if bad == torn {
+			t.Errorf("Replay(%v, %v): want bad '%v' got '%v'", n, torn, !torn, bad)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package mtdabi
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// OTPKind selects one of the two One-Time Programmable areas of an MTD.
+type OTPKind int
+
+const (
+	// OTPFactory is the OTP area programmed by the manufacturer.
+	OTPFactory OTPKind = unix.MTD_FILE_MODE_OTP_FACTORY
+	// OTPUser is the OTP area that can be programmed and locked by the user.
+	OTPUser OTPKind = unix.MTD_FILE_MODE_OTP_USER
+)
+
+func (k OTPKind) String() string {
+	switch k {
+	case OTPFactory:
+		return "factory"
+	case OTPUser:
+		return "user"
+	}
+	return fmt.Sprintf("OTPKind(%d)", int(k))
+}
+
+// OTPRegion is a region of an OTP area, with offsets relative to the start of
+// the area.
+type OTPRegion struct {
+	Start  int64
+	Length int64
+	Locked bool
+}
+
+// End returns the offset just past the end of the region.
+func (r OTPRegion) End() int64 {
+	return r.Start + r.Length
+}
+
+// OTPRegions returns the regions of the OTP area of the given kind, using
+// OTPGETREGIONCOUNT and OTPGETREGIONINFO. The file mode of the device is
+// restored afterwards.
+func (d *Device) OTPRegions(kind OTPKind) ([]OTPRegion, error) {
+	var regions []OTPRegion
+	err := d.withLock(func(d *Device) error {
+		return WithFileMode(d, uintptr(kind), func() error {
+			var err error
+			regions, err = d.otpRegions()
+			return err
+		})
+	})
+	return regions, err
+}
+
+// ReadOTP reads the whole OTP area of the given kind, covering all its
+// regions. The file mode of the device is restored afterwards.
+func (d *Device) ReadOTP(kind OTPKind) ([]byte, error) {
+	var buf []byte
+	err := d.withLock(func(d *Device) error {
+		return WithFileMode(d, uintptr(kind), func() error {
+			regions, err := d.otpRegions()
+			if err != nil {
+				return err
+			}
+			buf = make([]byte, otpSize(regions))
+			if len(buf) == 0 {
+				return nil
+			}
+			_, err = d.file.ReadAt(buf, 0)
+			return err
+		})
+	})
+	return buf, err
+}
+
+// WriteOTP programs data into the user OTP area at offset. The file mode of
+// the device is restored afterwards.
+func (d *Device) WriteOTP(offset int64, data []byte) error {
+	return d.withLock(func(d *Device) error {
+		return WithFileMode(d, uintptr(OTPUser), func() error {
+			if !d.NoValidate {
+				err := d.checkOTP("OTP write", offset, int64(len(data)))
+				if err != nil {
+					return err
+				}
+			}
+			_, err := d.file.WriteAt(data, offset)
+			return err
+		})
+	})
+}
+
+// LockOTP permanently locks the region of length bytes at offset of the user
+// OTP area, using OTPLOCK. The file mode of the device is restored afterwards.
+func (d *Device) LockOTP(offset, length int64) error {
+	return d.withLock(func(d *Device) error {
+		return WithFileMode(d, uintptr(OTPUser), func() error {
+			if !d.NoValidate {
+				err := d.checkOTP("OTP lock", offset, length)
+				if err != nil {
+					return err
+				}
+			}
+			value := unix.OtpInfo{
+				Start:  uint32(offset),
+				Length: uint32(length),
+			}
+			return OtpLock(d.Fd(), &value)
+		})
+	})
+}
+
+// otpRegions returns the regions of the OTP area selected by the current file
+// mode. OTPGETREGIONINFO fills an array with as many entries as reported by
+// OTPGETREGIONCOUNT.
+func (d *Device) otpRegions() ([]OTPRegion, error) {
+	var count int32
+	err := OtpGetRegionCount(d.Fd(), &count)
+	if err != nil {
+		return nil, fmt.Errorf("OtpGetRegionCount failed: %w", err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	infos := make([]unix.OtpInfo, count)
+	err = OtpGetRegionInfo(d.Fd(), &infos[0])
+	runtime.KeepAlive(infos)
+	if err != nil {
+		return nil, fmt.Errorf("OtpGetRegionInfo failed: %w", err)
+	}
+	regions := make([]OTPRegion, count)
+	for i, info := range infos {
+		regions[i] = OTPRegion{
+			Start:  int64(info.Start),
+			Length: int64(info.Length),
+			Locked: info.Locked != 0,
+		}
+	}
+	return regions, nil
+}
+
+// checkOTP checks that the region of length bytes at offset is within the OTP
+// area selected by the current file mode.
+func (d *Device) checkOTP(op string, offset, length int64) error {
+	regions, err := d.otpRegions()
+	if err != nil {
+		return err
+	}
+	return checkBounds(otpSize(regions), op, offset, length)
+}
+
+// otpSize returns the size of the OTP area made up of regions.
+func otpSize(regions []OTPRegion) int64 {
+	size := int64(0)
+	for _, r := range regions {
+		if r.End() > size {
+			size = r.End()
+		}
+	}
+	return size
+}
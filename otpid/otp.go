@@ -0,0 +1,149 @@
+package otpid
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// Errors returned when programming a record, to be tested with errors.Is.
+var (
+	// ErrAlreadyProgrammed means the record area is not erased anymore.
+	ErrAlreadyProgrammed = errors.New("record area already programmed")
+	// ErrLocked means the record area lies in a locked OTP region.
+	ErrLocked = errors.New("record area locked")
+	// ErrVerify means the record read back differs from the one written.
+	ErrVerify = errors.New("record verification failed")
+)
+
+// OTP is the user OTP access implemented by *mtdabi.Device and by simulated
+// devices.
+type OTP interface {
+	OTPRegions(kind mtdabi.OTPKind) ([]mtdabi.OTPRegion, error)
+	ReadOTP(kind mtdabi.OTPKind) ([]byte, error)
+	WriteOTP(offset int64, data []byte) error
+	LockOTP(offset, length int64) error
+}
+
+var _ OTP = (*mtdabi.Device)(nil)
+
+// Write encodes r and programs it once into the user OTP area at offset,
+// then reads it back to verify it. The record area must still be erased and
+// unlocked.
+func Write(otp OTP, offset int64, schema Schema, r *Record) error {
+	buf, err := schema.Marshal(r)
+	if err != nil {
+		return err
+	}
+	area, err := otp.ReadOTP(mtdabi.OTPUser)
+	if err != nil {
+		return err
+	}
+	end := offset + int64(len(buf))
+	if offset < 0 || end > int64(len(area)) {
+		return fmt.Errorf("record of %v bytes at 0x%x does not fit OTP area of %v bytes",
+			len(buf), offset, len(area))
+	}
+	if !mtdabi.IsErased(area[offset:end]) {
+		return fmt.Errorf("%w at 0x%x", ErrAlreadyProgrammed, offset)
+	}
+	regions, err := otp.OTPRegions(mtdabi.OTPUser)
+	if err != nil {
+		return err
+	}
+	for _, region := range overlapping(regions, offset, end) {
+		if region.Locked {
+			return fmt.Errorf("%w: region at 0x%x", ErrLocked, region.Start)
+		}
+	}
+	err = otp.WriteOTP(offset, buf)
+	if err != nil {
+		return err
+	}
+	return Verify(otp, offset, schema, r)
+}
+
+// Read reads and decodes the record at offset of the user OTP area.
+func Read(otp OTP, offset int64, schema Schema) (*Record, error) {
+	r, _, err := read(otp, offset, schema)
+	return r, err
+}
+
+// Verify reads the record at offset of the user OTP area and checks that it
+// holds the same fields as r.
+func Verify(otp OTP, offset int64, schema Schema, r *Record) error {
+	want, err := schema.Marshal(r)
+	if err != nil {
+		return err
+	}
+	area, err := otp.ReadOTP(mtdabi.OTPUser)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > int64(len(area)) {
+		return fmt.Errorf("record offset 0x%x outside OTP area of %v bytes", offset, len(area))
+	}
+	if !bytes.HasPrefix(area[offset:], want) {
+		return fmt.Errorf("%w at 0x%x", ErrVerify, offset)
+	}
+	return nil
+}
+
+// Lock permanently locks the OTP regions holding the record at offset. The
+// record must be valid, so that an incomplete record is never locked in.
+func Lock(otp OTP, offset int64, schema Schema) error {
+	_, size, err := read(otp, offset, schema)
+	if err != nil {
+		return err
+	}
+	regions, err := otp.OTPRegions(mtdabi.OTPUser)
+	if err != nil {
+		return err
+	}
+	for _, region := range overlapping(regions, offset, offset+int64(size)) {
+		if region.Locked {
+			continue
+		}
+		err = otp.LockOTP(region.Start, region.Length)
+		if err != nil {
+			return fmt.Errorf("locking OTP region at 0x%x: %w", region.Start, err)
+		}
+	}
+	return nil
+}
+
+// Provision writes, verifies and locks the record at offset of the user OTP
+// area.
+func Provision(otp OTP, offset int64, schema Schema, r *Record) error {
+	err := Write(otp, offset, schema, r)
+	if err != nil {
+		return err
+	}
+	return Lock(otp, offset, schema)
+}
+
+// read reads and decodes the record at offset of the user OTP area, and
+// returns its encoded size.
+func read(otp OTP, offset int64, schema Schema) (*Record, int, error) {
+	area, err := otp.ReadOTP(mtdabi.OTPUser)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset < 0 || offset > int64(len(area)) {
+		return nil, 0, fmt.Errorf("record offset 0x%x outside OTP area of %v bytes", offset, len(area))
+	}
+	return schema.Unmarshal(area[offset:])
+}
+
+// overlapping returns the regions overlapping [start, end).
+func overlapping(regions []mtdabi.OTPRegion, start, end int64) []mtdabi.OTPRegion {
+	var result []mtdabi.OTPRegion
+	for _, r := range regions {
+		if start < r.End() && r.Start < end {
+			result = append(result, r)
+		}
+	}
+	return result
+}
@@ -0,0 +1,148 @@
+package otpid
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+	"golang.org/x/sys/unix"
+)
+
+var mac = net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x20, 0x30}
+
+// newSim returns a simulated SPI-NOR flash with 4 user OTP regions of 64 bytes.
+func newSim(t *testing.T) *mtdsim.Sim {
+	sim, err := mtdsim.New(mtdsim.Config{
+		Info: unix.MtdInfo{
+			Type:      unix.MTD_NORFLASH,
+			Size:      0x40000,
+			Erasesize: 0x10000,
+			Writesize: 1,
+		},
+		UserOTP: []int64{64, 64, 64, 64},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create simulated MTD: %v", err)
+	}
+	return sim
+}
+
+func TestProvisionAndRead(t *testing.T) {
+	sim := newSim(t)
+	want := NewIdentity("SN-000123", mac)
+
+	_, err := Read(sim, 0, DefaultSchema)
+	if !errors.Is(err, ErrNotProgrammed) {
+		t.Fatalf("Read err: want '%v' got '%v'", ErrNotProgrammed, err)
+	}
+
+	err = Provision(sim, 0, DefaultSchema, want)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	got, err := Read(sim, 0, DefaultSchema)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Record: want '%v' got '%v'", want, got)
+	}
+	if got.Serial() != "SN-000123" || !reflect.DeepEqual(got.MACs(), []net.HardwareAddr{mac}) {
+		t.Errorf("Identity: got serial '%v' MACs '%v'", got.Serial(), got.MACs())
+	}
+
+	// Only the region holding the record is locked
+	regions, err := sim.OTPRegions(mtdabi.OTPUser)
+	if err != nil {
+		t.Fatalf("OTPRegions failed: %v", err)
+	}
+	for i, r := range regions {
+		if r.Locked != (i == 0) {
+			t.Errorf("Region %v: want locked '%v' got '%v'", i, i == 0, r.Locked)
+		}
+	}
+}
+
+func TestWriteAlreadyProgrammed(t *testing.T) {
+	sim := newSim(t)
+	err := Write(sim, 0, DefaultSchema, NewIdentity("SN-1"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	err = Write(sim, 0, DefaultSchema, NewIdentity("SN-2"))
+	if !errors.Is(err, ErrAlreadyProgrammed) {
+		t.Fatalf("Write err: want '%v' got '%v'", ErrAlreadyProgrammed, err)
+	}
+	got, err := Read(sim, 0, DefaultSchema)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got.Serial() != "SN-1" {
+		t.Errorf("Serial: want '%v' got '%v'", "SN-1", got.Serial())
+	}
+}
+
+func TestWriteLocked(t *testing.T) {
+	sim := newSim(t)
+	err := sim.LockOTP(64, 64)
+	if err != nil {
+		t.Fatalf("LockOTP failed: %v", err)
+	}
+	// The record spans into the locked second region
+	err = Write(sim, 60, DefaultSchema, NewIdentity("SN-3"))
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Write err: want '%v' got '%v'", ErrLocked, err)
+	}
+	// Bypassing the check, the flash itself refuses the write
+	err = sim.WriteOTP(64, []byte{0})
+	if err != unix.EROFS {
+		t.Fatalf("WriteOTP err: want '%v' got '%v'", unix.EROFS, err)
+	}
+}
+
+func TestLockInvalidRecord(t *testing.T) {
+	sim := newSim(t)
+	err := sim.WriteOTP(0, []byte("MTID\x01\x00\x00\x00\x00\x00\x00\x00"))
+	if err != nil {
+		t.Fatalf("WriteOTP failed: %v", err)
+	}
+	err = Lock(sim, 0, DefaultSchema)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Lock err: want '%v' got '%v'", ErrCorrupt, err)
+	}
+	regions, err := sim.OTPRegions(mtdabi.OTPUser)
+	if err != nil {
+		t.Fatalf("OTPRegions failed: %v", err)
+	}
+	if regions[0].Locked {
+		t.Errorf("Region 0: want unlocked")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	for _, r := range []*Record{
+		{},
+		NewIdentity(""),
+		NewIdentity("SN", net.HardwareAddr{1, 2, 3}),
+		{Fields: []Field{{Tag: TagSerial, Value: []byte("a")}, {Tag: TagSerial, Value: []byte("b")}}},
+		{Fields: []Field{{Tag: TagSerial, Value: []byte("a")}, {Tag: 9, Value: []byte("b")}}},
+	} {
+		_, err := DefaultSchema.Marshal(r)
+		if err == nil {
+			t.Errorf("Marshal '%v': want error", r)
+		}
+	}
+
+	buf, err := DefaultSchema.Marshal(NewIdentity("SN-4", mac, mac))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	buf[len(buf)-5] ^= 1
+	_, _, err = DefaultSchema.Unmarshal(buf)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Unmarshal err: want '%v' got '%v'", ErrCorrupt, err)
+	}
+}
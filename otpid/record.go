@@ -0,0 +1,233 @@
+// Package otpid stores device identity records (serial numbers, MAC addresses)
+// in the user OTP (One-Time Programmable) area of an MTD.
+//
+// A record is encoded as a small versioned, CRC-protected TLV structure, all
+// integers big-endian:
+//
+//	offset  size  content
+//	0       4     magic "MTID"
+//	4       1     format version (1)
+//	5       1     reserved (0)
+//	6       2     payload length N
+//	8       N     fields: tag (1 byte), length (1 byte), value
+//	8+N     4     CRC-32 (IEEE) of bytes [0, 8+N)
+//
+// Which tags may appear, and with which sizes, is described by a Schema.
+package otpid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// Version is the record format version written by Marshal.
+const Version = 1
+
+const (
+	headerSize = 8
+	crcSize    = 4
+)
+
+var magic = []byte("MTID")
+
+// Errors returned when decoding a record, to be tested with errors.Is.
+var (
+	// ErrNotProgrammed means the record area is still erased.
+	ErrNotProgrammed = errors.New("record not programmed")
+	// ErrCorrupt means the record area does not hold a valid record.
+	ErrCorrupt = errors.New("record corrupt")
+)
+
+// Tag identifies the kind of a field.
+type Tag uint8
+
+// Tags of the fields in DefaultSchema.
+const (
+	TagSerial Tag = 1
+	TagMAC    Tag = 2
+)
+
+// Field is a field of a record.
+type Field struct {
+	Tag   Tag
+	Value []byte
+}
+
+// Record is a device identity record: an ordered list of fields.
+type Record struct {
+	Fields []Field
+}
+
+// NewIdentity returns a record holding a serial number and MAC addresses,
+// conforming to DefaultSchema.
+func NewIdentity(serial string, macs ...net.HardwareAddr) *Record {
+	r := &Record{}
+	r.Add(TagSerial, []byte(serial))
+	for _, mac := range macs {
+		r.Add(TagMAC, mac)
+	}
+	return r
+}
+
+// Add appends a field to the record.
+func (r *Record) Add(tag Tag, value []byte) {
+	r.Fields = append(r.Fields, Field{Tag: tag, Value: append([]byte(nil), value...)})
+}
+
+// Get returns the value of the first field with the given tag.
+func (r *Record) Get(tag Tag) ([]byte, bool) {
+	for _, f := range r.Fields {
+		if f.Tag == tag {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Serial returns the serial number of the record.
+func (r *Record) Serial() string {
+	v, _ := r.Get(TagSerial)
+	return string(v)
+}
+
+// MACs returns the MAC addresses of the record, in order.
+func (r *Record) MACs() []net.HardwareAddr {
+	var macs []net.HardwareAddr
+	for _, f := range r.Fields {
+		if f.Tag == TagMAC {
+			macs = append(macs, net.HardwareAddr(f.Value))
+		}
+	}
+	return macs
+}
+
+// FieldSpec describes the field with a given tag.
+type FieldSpec struct {
+	Tag  Tag
+	Name string
+	// Size is the size of the value in bytes, or 0 for values of any size
+	// from 1 to 255 bytes.
+	Size int
+	// Required fields must appear in every record.
+	Required bool
+	// Repeated fields may appear more than once.
+	Repeated bool
+}
+
+// Schema lists the fields that may appear in a record.
+type Schema []FieldSpec
+
+// DefaultSchema holds a required serial number and any number of MAC
+// addresses.
+var DefaultSchema = Schema{
+	{Tag: TagSerial, Name: "serial", Required: true},
+	{Tag: TagMAC, Name: "mac", Size: 6, Repeated: true},
+}
+
+// Validate checks that every field of r is described by the schema with the
+// right size and count, and that all required fields are present.
+func (s Schema) Validate(r *Record) error {
+	counts := make(map[Tag]int)
+	for _, f := range r.Fields {
+		spec, ok := s.spec(f.Tag)
+		if !ok {
+			return fmt.Errorf("field with tag %v not in schema", f.Tag)
+		}
+		if len(f.Value) == 0 || len(f.Value) > 255 || (spec.Size != 0 && len(f.Value) != spec.Size) {
+			return fmt.Errorf("field %v: invalid size %v", spec.Name, len(f.Value))
+		}
+		counts[f.Tag]++
+		if counts[f.Tag] > 1 && !spec.Repeated {
+			return fmt.Errorf("field %v: repeated", spec.Name)
+		}
+	}
+	for _, spec := range s {
+		if spec.Required && counts[spec.Tag] == 0 {
+			return fmt.Errorf("field %v: missing", spec.Name)
+		}
+	}
+	return nil
+}
+
+// Marshal validates r against the schema and encodes it.
+func (s Schema) Marshal(r *Record) ([]byte, error) {
+	err := s.Validate(r)
+	if err != nil {
+		return nil, err
+	}
+	var payload bytes.Buffer
+	for _, f := range r.Fields {
+		payload.WriteByte(byte(f.Tag))
+		payload.WriteByte(byte(len(f.Value)))
+		payload.Write(f.Value)
+	}
+	if payload.Len() > 0xffff {
+		return nil, fmt.Errorf("payload of %v bytes too large", payload.Len())
+	}
+	buf := make([]byte, headerSize, headerSize+payload.Len()+crcSize)
+	copy(buf, magic)
+	buf[4] = Version
+	binary.BigEndian.PutUint16(buf[6:], uint16(payload.Len()))
+	buf = append(buf, payload.Bytes()...)
+	return appendCRC(buf), nil
+}
+
+// Unmarshal decodes a record from the start of buf and validates it against
+// the schema. It also returns the encoded size of the record.
+func (s Schema) Unmarshal(buf []byte) (*Record, int, error) {
+	if len(buf) >= headerSize && mtdabi.IsErased(buf[:headerSize]) {
+		return nil, 0, ErrNotProgrammed
+	}
+	if len(buf) < headerSize+crcSize || !bytes.Equal(buf[:4], magic) {
+		return nil, 0, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	if buf[4] != Version {
+		return nil, 0, fmt.Errorf("%w: unsupported version %v", ErrCorrupt, buf[4])
+	}
+	size := headerSize + int(binary.BigEndian.Uint16(buf[6:])) + crcSize
+	if size > len(buf) {
+		return nil, 0, fmt.Errorf("%w: record of %v bytes truncated to %v", ErrCorrupt, size, len(buf))
+	}
+	body := buf[:size-crcSize]
+	want := binary.BigEndian.Uint32(buf[size-crcSize:])
+	if got := crc32.ChecksumIEEE(body); got != want {
+		return nil, 0, fmt.Errorf("%w: CRC 0x%08x, want 0x%08x", ErrCorrupt, got, want)
+	}
+	r := &Record{}
+	for payload := body[headerSize:]; len(payload) > 0; {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return nil, 0, fmt.Errorf("%w: truncated field", ErrCorrupt)
+		}
+		end := 2 + int(payload[1])
+		r.Add(Tag(payload[0]), payload[2:end])
+		payload = payload[end:]
+	}
+	err := s.Validate(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return r, size, nil
+}
+
+// spec returns the description of the field with the given tag.
+func (s Schema) spec(tag Tag) (FieldSpec, bool) {
+	for _, spec := range s {
+		if spec.Tag == tag {
+			return spec, true
+		}
+	}
+	return FieldSpec{}, false
+}
+
+// appendCRC appends the CRC-32 of buf to buf.
+func appendCRC(buf []byte) []byte {
+	var crc [crcSize]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf))
+	return append(buf, crc[:]...)
+}
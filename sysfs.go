@@ -0,0 +1,35 @@
+package mtdabi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// SysfsRoot is the sysfs directory holding one directory per MTD device.
+const SysfsRoot = "/sys/class/mtd"
+
+// SysfsAttr reads the sysfs attribute name (e.g., "subpagesize") of the MTD
+// device with the given number, without the trailing newline.
+func SysfsAttr(mtdNum int, name string) (string, error) {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("%v/mtd%d/%v", SysfsRoot, mtdNum, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// SysfsInt reads the integer sysfs attribute name of the MTD device with the
+// given number. Values may be decimal or hexadecimal with a 0x prefix.
+func SysfsInt(mtdNum int, name string) (int64, error) {
+	s, err := SysfsAttr(mtdNum, name)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("sysfs attribute %v of mtd%d: %w", name, mtdNum, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,295 @@
+package ubi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// layoutVolumeCompat is the compatibility flag of the layout volume
+	// (UBI_COMPAT_REJECT)
+	layoutVolumeCompat = 5
+	// VtblAutoresizeFlg marks the volume UBI grows to fill the device on
+	// first attach (UBI_VTBL_AUTORESIZE_FLG)
+	VtblAutoresizeFlg = 0x01
+)
+
+// Layout is the geometry of the flash a UBI image is built for, from which
+// the positions of the headers and the LEB size follow.
+type Layout struct {
+	// PEBSize is the eraseblock size, unix.MtdInfo.Erasesize.
+	PEBSize int
+	// MinIOSize is the minimum write unit, unix.MtdInfo.Writesize.
+	MinIOSize int
+	// SubpageSize is the sub-page size, as found in the "subpagesize" sysfs
+	// attribute of the MTD. If 0, MinIOSize is used.
+	SubpageSize int
+	// VIDHdrOffset is the offset of the VID header in each PEB. If 0, it is
+	// put in the sub-page following the EC header, like ubinize does.
+	VIDHdrOffset int
+	// EC is the erase counter written to the EC headers.
+	EC uint64
+	// ImageSeq is the image sequence number written to the EC headers.
+	ImageSeq uint32
+}
+
+// NewLayout returns the layout of the MTD described by info, with the given
+// sub-page size (0 if unknown).
+func NewLayout(info unix.MtdInfo, subpageSize int) Layout {
+	return Layout{
+		PEBSize:     int(info.Erasesize),
+		MinIOSize:   int(info.Writesize),
+		SubpageSize: subpageSize,
+	}
+}
+
+// LayoutOf returns the layout of the MTD with the given number, reading its
+// geometry from dev and its sub-page size from sysfs.
+func LayoutOf(dev *mtdabi.Device, mtdNum int) (Layout, error) {
+	subpageSize, err := mtdabi.SysfsInt(mtdNum, "subpagesize")
+	if err != nil {
+		return Layout{}, err
+	}
+	return NewLayout(dev.Info(), int(subpageSize)), nil
+}
+
+// offsets returns the offsets of the VID header and of the data in each PEB.
+func (l Layout) offsets() (vidHdrOffset, dataOffset int) {
+	subpageSize := l.SubpageSize
+	if subpageSize == 0 {
+		subpageSize = l.MinIOSize
+	}
+	vidHdrOffset = l.VIDHdrOffset
+	if vidHdrOffset == 0 {
+		vidHdrOffset = int(mtdabi.RoundUp(ECHdrSize, int64(subpageSize)))
+	}
+	dataOffset = int(mtdabi.RoundUp(int64(vidHdrOffset+VIDHdrSize), int64(l.MinIOSize)))
+	return vidHdrOffset, dataOffset
+}
+
+// LEBSize returns the size of the LEBs of the layout.
+func (l Layout) LEBSize() int {
+	_, dataOffset := l.offsets()
+	return l.PEBSize - dataOffset
+}
+
+// VolumeSpec describes a volume of a UBI image.
+type VolumeSpec struct {
+	// ID is the volume ID, or VolNumAuto for the next free one.
+	ID   int
+	Name string
+	// Type is DynamicVolume or StaticVolume.
+	Type int
+	// Size is the size reserved for the volume in bytes. If 0, the size of
+	// Data is used.
+	Size int64
+	// Alignment of the LEB size; the LEBs of the volume are shortened by the
+	// remainder of the LEB size divided by Alignment. If 0, 1 is used.
+	Alignment int
+	// Autoresize makes UBI grow the volume to the whole free space on first
+	// attach.
+	Autoresize bool
+	// Data is the initial contents of the volume.
+	Data []byte
+}
+
+// Build writes a UBI image made of the layout volume followed by the given
+// volumes to w, like ubinize. Only the PEBs in use are written; UBI formats
+// the remaining PEBs of the MTD on first attach.
+func Build(w io.Writer, l Layout, vols []VolumeSpec) error {
+	if l.PEBSize <= 0 || l.MinIOSize <= 0 || l.PEBSize%l.MinIOSize != 0 {
+		return fmt.Errorf("invalid layout: PEB size %v, min I/O size %v", l.PEBSize, l.MinIOSize)
+	}
+	vidHdrOffset, dataOffset := l.offsets()
+	if vidHdrOffset < ECHdrSize || dataOffset >= l.PEBSize {
+		return fmt.Errorf("invalid layout: VID header at 0x%x, data at 0x%x", vidHdrOffset, dataOffset)
+	}
+	b := &builder{w: w, l: l, vidHdrOffset: vidHdrOffset, dataOffset: dataOffset}
+	lebSize := l.LEBSize()
+	records := make([]VtblRecord, vtblRecords(lebSize))
+
+	used := make(map[int]bool)
+	for i := range vols {
+		if vols[i].ID != VolNumAuto {
+			used[vols[i].ID] = true
+		}
+	}
+	data := make(map[int][]byte)
+	next := 0
+	autoresize := false
+	names := make(map[string]bool)
+	for i := range vols {
+		v := &vols[i]
+		id := v.ID
+		if id == VolNumAuto {
+			for used[next] {
+				next++
+			}
+			id = next
+			used[id] = true
+		}
+		if id < 0 || id >= len(records) || records[id].ReservedPEBs != 0 {
+			return fmt.Errorf("volume %q: invalid or duplicate ID %v", v.Name, id)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("volume %q: duplicate name", v.Name)
+		}
+		names[v.Name] = true
+		record, err := newRecord(v, lebSize)
+		if err != nil {
+			return err
+		}
+		if v.Autoresize {
+			if autoresize {
+				return fmt.Errorf("volume %q: only one volume can be auto-resized", v.Name)
+			}
+			autoresize = true
+		}
+		records[id] = record
+		data[id] = v.Data
+	}
+
+	var vtbl bytes.Buffer
+	for i := range records {
+		buf, err := records[i].MarshalBinary()
+		if err != nil {
+			return err
+		}
+		vtbl.Write(buf)
+	}
+	for lnum := 0; lnum < LayoutVolumeEBS; lnum++ {
+		err := b.writePEB(&VIDHeader{
+			VolType: VIDDynamic,
+			Compat:  layoutVolumeCompat,
+			VolID:   LayoutVolumeID,
+			Lnum:    uint32(lnum),
+		}, vtbl.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	for id := range records {
+		if records[id].ReservedPEBs == 0 {
+			continue
+		}
+		err := b.writeVolume(uint32(id), records[id], data[id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRecord returns the volume table record of v.
+func newRecord(v *VolumeSpec, lebSize int) (VtblRecord, error) {
+	if v.Name == "" || len(v.Name) > MaxVolumeName {
+		return VtblRecord{}, fmt.Errorf("volume %q: invalid name", v.Name)
+	}
+	alignment := v.Alignment
+	if alignment == 0 {
+		alignment = 1
+	}
+	if alignment < 0 || alignment > lebSize {
+		return VtblRecord{}, fmt.Errorf("volume %q: invalid alignment %v", v.Name, alignment)
+	}
+	var volType uint8
+	switch v.Type {
+	case DynamicVolume:
+		volType = VIDDynamic
+	case StaticVolume:
+		volType = VIDStatic
+	default:
+		return VtblRecord{}, fmt.Errorf("volume %q: invalid type %v", v.Name, v.Type)
+	}
+	size := v.Size
+	if size == 0 {
+		size = int64(len(v.Data))
+	}
+	if size < int64(len(v.Data)) {
+		return VtblRecord{}, fmt.Errorf("volume %q: data of %v bytes larger than volume size %v",
+			v.Name, len(v.Data), size)
+	}
+	dataPad := lebSize % alignment
+	usable := int64(lebSize - dataPad)
+	reserved := (size + usable - 1) / usable
+	if reserved == 0 {
+		reserved = 1
+	}
+	record := VtblRecord{
+		ReservedPEBs: uint32(reserved),
+		Alignment:    uint32(alignment),
+		DataPad:      uint32(dataPad),
+		VolType:      volType,
+		Name:         v.Name,
+	}
+	if v.Autoresize {
+		record.Flags |= VtblAutoresizeFlg
+	}
+	return record, nil
+}
+
+// builder writes the PEBs of a UBI image.
+type builder struct {
+	w            io.Writer
+	l            Layout
+	vidHdrOffset int
+	dataOffset   int
+}
+
+// writeVolume writes the PEBs holding data for the volume with the given ID.
+func (b *builder) writeVolume(id uint32, record VtblRecord, data []byte) error {
+	usable := b.l.LEBSize() - int(record.DataPad)
+	usedEBs := (len(data) + usable - 1) / usable
+	for lnum := 0; lnum < usedEBs; lnum++ {
+		chunk := data[lnum*usable:]
+		if len(chunk) > usable {
+			chunk = chunk[:usable]
+		}
+		vid := &VIDHeader{
+			VolType: record.VolType,
+			VolID:   id,
+			Lnum:    uint32(lnum),
+			DataPad: record.DataPad,
+		}
+		if record.VolType == VIDStatic {
+			vid.DataSize = uint32(len(chunk))
+			vid.UsedEBs = uint32(usedEBs)
+			vid.DataCRC = crc(chunk)
+		}
+		err := b.writePEB(vid, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePEB writes a PEB holding the VID header vid and data.
+func (b *builder) writePEB(vid *VIDHeader, data []byte) error {
+	peb := bytes.Repeat([]byte{0xff}, b.l.PEBSize)
+	ec := &ECHeader{
+		Version:      Version,
+		EC:           b.l.EC,
+		VIDHdrOffset: uint32(b.vidHdrOffset),
+		DataOffset:   uint32(b.dataOffset),
+		ImageSeq:     b.l.ImageSeq,
+	}
+	hdr, err := ec.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	copy(peb, hdr)
+	vid.Version = Version
+	hdr, err = vid.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	copy(peb[b.vidHdrOffset:], hdr)
+	copy(peb[b.dataOffset:], data)
+	_, err = b.w.Write(peb)
+	return err
+}
@@ -0,0 +1,107 @@
+package ubi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuild(t *testing.T) {
+	// 128KiB PEBs of 2KiB pages with 512 bytes sub-pages
+	info := unix.MtdInfo{Type: unix.MTD_NANDFLASH, Size: 0x1000000, Erasesize: 0x20000, Writesize: 0x800, Oobsize: 0x40}
+	l := NewLayout(info, 0x200)
+	l.ImageSeq = 0x1234
+	if l.LEBSize() != 0x20000-0x800 {
+		t.Fatalf("LEBSize: want '0x%x' got '0x%x'", 0x20000-0x800, l.LEBSize())
+	}
+
+	kernel := bytes.Repeat([]byte("kernel"), 40000)
+	rootfs := bytes.Repeat([]byte("rootfs"), 1000)
+	var image bytes.Buffer
+	err := Build(&image, l, []VolumeSpec{
+		{ID: VolNumAuto, Name: "kernel", Type: StaticVolume, Data: kernel},
+		{ID: 0, Name: "rootfs", Type: DynamicVolume, Size: 0x100000, Data: rootfs},
+		{ID: VolNumAuto, Name: "data", Type: DynamicVolume, Size: 0x40000, Autoresize: true},
+	})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	// 2 layout PEBs, 1 rootfs PEB, 2 kernel PEBs, in volume ID order
+	if image.Len() != 5*l.PEBSize {
+		t.Fatalf("Image size: want '%v' got '%v'", 5*l.PEBSize, image.Len())
+	}
+
+	img, err := Parse(bytes.NewReader(image.Bytes()), int64(image.Len()), l.PEBSize)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if img.VtblErr != nil {
+		t.Fatalf("VtblErr: %v", img.VtblErr)
+	}
+	for _, peb := range img.PEBs {
+		if peb.Err != nil || peb.EC.VIDHdrOffset != 0x200 || peb.EC.DataOffset != 0x800 || peb.EC.ImageSeq != 0x1234 {
+			t.Errorf("PEB %v: got EC '%+v' err '%v'", peb.Num, peb.EC, peb.Err)
+		}
+	}
+
+	want := []struct {
+		id       int
+		name     string
+		reserved uint32
+		lebs     map[int]int
+		flags    uint8
+	}{
+		{0, "rootfs", 9, map[int]int{0: 2}, 0},
+		{1, "kernel", 2, map[int]int{0: 3, 1: 4}, 0},
+		{2, "data", 3, map[int]int{}, VtblAutoresizeFlg},
+	}
+	if len(img.Volumes) != len(want) {
+		t.Fatalf("Volumes: want %v got %v", len(want), len(img.Volumes))
+	}
+	for i, w := range want {
+		vol := img.Volumes[i]
+		if vol.ID != w.id || vol.Record.Name != w.name || vol.Record.ReservedPEBs != w.reserved ||
+			vol.Record.Flags != w.flags || !reflect.DeepEqual(vol.LEBs, w.lebs) {
+			t.Errorf("Volume %v: got '%+v'", w.id, vol)
+		}
+	}
+
+	var got []byte
+	for lnum := 0; lnum < 2; lnum++ {
+		leb, err := img.ReadLEB(1, lnum)
+		if err != nil {
+			t.Fatalf("ReadLEB failed: %v", err)
+		}
+		got = append(got, leb...)
+	}
+	if !bytes.Equal(got, kernel) {
+		t.Errorf("Static volume contents differ")
+	}
+	leb, err := img.ReadLEB(0, 0)
+	if err != nil {
+		t.Fatalf("ReadLEB failed: %v", err)
+	}
+	if !bytes.HasPrefix(leb, rootfs) || !mtdabi.IsErased(leb[len(rootfs):]) {
+		t.Errorf("Dynamic volume contents differ")
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	l := Layout{PEBSize: 0x4000, MinIOSize: 0x200}
+	for _, vols := range [][]VolumeSpec{
+		{{ID: 0, Name: "a", Type: DynamicVolume, Size: 1}, {ID: 0, Name: "b", Type: DynamicVolume, Size: 1}},
+		{{ID: 0, Name: "a", Type: DynamicVolume, Size: 1}, {ID: 1, Name: "a", Type: DynamicVolume, Size: 1}},
+		{{ID: 0, Name: "", Type: DynamicVolume, Size: 1}},
+		{{ID: 0, Name: "a", Type: 1, Size: 1}},
+		{{ID: 0, Name: "a", Type: DynamicVolume, Size: 1, Data: []byte("ab")}},
+		{{ID: 0, Name: "a", Type: DynamicVolume, Size: 1, Autoresize: true}, {ID: 1, Name: "b", Type: DynamicVolume, Size: 1, Autoresize: true}},
+	} {
+		err := Build(&bytes.Buffer{}, l, vols)
+		if err == nil {
+			t.Errorf("Build '%+v': want error", vols)
+		}
+	}
+}
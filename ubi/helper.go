@@ -0,0 +1,34 @@
+package ubi
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Directions of ioctl request numbers, derived from requests of the MTD ABI
+// whose numbers golang.org/x/sys/unix defines for every architecture.
+const (
+	iocWrite = unix.MEMERASE - (8<<16 | 'M'<<8 | 2)
+	iocRead  = unix.MEMGETINFO - (32<<16 | 'M'<<8 | 1)
+)
+
+// ioc encodes an ioctl request number like the kernel's _IOC macro.
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	return dir | size<<16 | typ<<8 | nr
+}
+
+// ioctl performs an ioctl operation specified by req and sets & gets the value
+// on the device pointed by fd.
+func ioctl(fd, req, value uintptr) error {
+	_, err := ioctlRet(fd, req, value)
+	return err
+}
+
+// ioctlRet is like ioctl, but also returns the non-negative return value of the
+// ioctl call, which some requests (e.g., UBI_IOCEBISMAP) use as their result.
+func ioctlRet(fd, req, value uintptr) (int, error) {
+	r, _, err := unix.Syscall(unix.SYS_IOCTL, fd, req, value)
+	if err != 0 {
+		return 0, err
+	}
+	return int(r), nil
+}
@@ -0,0 +1,285 @@
+package ubi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// PEBState is the state of a PEB found in a UBI image.
+type PEBState int
+
+const (
+	// PEBEmpty is an erased PEB without EC header.
+	PEBEmpty PEBState = iota
+	// PEBFree is a PEB with an EC header but no VID header.
+	PEBFree
+	// PEBUsed is a PEB holding a LEB of a volume.
+	PEBUsed
+	// PEBCorrupt is a PEB with an invalid EC or VID header.
+	PEBCorrupt
+)
+
+func (s PEBState) String() string {
+	switch s {
+	case PEBEmpty:
+		return "empty"
+	case PEBFree:
+		return "free"
+	case PEBUsed:
+		return "used"
+	case PEBCorrupt:
+		return "corrupt"
+	}
+	return fmt.Sprintf("PEBState(%d)", int(s))
+}
+
+// PEB is a physical eraseblock of a UBI image.
+type PEB struct {
+	Num   int
+	State PEBState
+	// EC is nil for empty PEBs, and for corrupt PEBs without a valid EC
+	// header.
+	EC *ECHeader
+	// VID is only set for used PEBs.
+	VID *VIDHeader
+	// Err tells why the PEB is corrupt, or why the data of a used PEB does
+	// not match its VID header's data CRC.
+	Err error
+}
+
+// Volume is a volume of a UBI image, as described by the volume table.
+type Volume struct {
+	ID     int
+	Record VtblRecord
+	// LEBs maps the LEB numbers of the volume to the PEBs holding them.
+	LEBs map[int]int
+}
+
+// Image is a parsed UBI image, e.g., dumped from the MTD holding a UBI device.
+type Image struct {
+	PEBSize int
+	PEBs    []PEB
+	// Volumes are the volumes of the volume table, by increasing ID.
+	Volumes []*Volume
+	// VtblErr tells why the volume table could not be reconstructed, in
+	// which case Volumes is empty.
+	VtblErr error
+
+	r io.ReaderAt
+	// lebs maps volume IDs and LEB numbers to PEB numbers.
+	lebs map[uint32]map[int]int
+}
+
+// Parse parses a UBI image of size bytes read from r, made of PEBs of
+// pebSize bytes. It validates the CRCs of all EC and VID headers and of the
+// data of static volumes and copied LEBs, resolves which PEB holds each LEB,
+// and reconstructs the volume table. Corrupt PEBs and an unreadable volume
+// table are reported in the returned Image; Parse itself only fails if r
+// cannot be read.
+func Parse(r io.ReaderAt, size int64, pebSize int) (*Image, error) {
+	if pebSize < ECHdrSize+VIDHdrSize {
+		return nil, fmt.Errorf("PEB size %v too small", pebSize)
+	}
+	img := &Image{
+		PEBSize: pebSize,
+		PEBs:    make([]PEB, size/int64(pebSize)),
+		r:       r,
+		lebs:    make(map[uint32]map[int]int),
+	}
+	buf := make([]byte, pebSize)
+	for i := range img.PEBs {
+		_, err := r.ReadAt(buf, int64(i)*int64(pebSize))
+		if err != nil {
+			return nil, fmt.Errorf("reading PEB %v: %w", i, err)
+		}
+		img.PEBs[i] = parsePEB(i, buf)
+		img.resolve(i)
+	}
+	img.readVtbl()
+	return img, nil
+}
+
+// parsePEB parses the headers of PEB num with contents buf.
+func parsePEB(num int, buf []byte) PEB {
+	peb := PEB{Num: num, State: PEBCorrupt}
+	if mtdabi.IsErased(buf[:ECHdrSize]) {
+		peb.State = PEBEmpty
+		return peb
+	}
+	ec := &ECHeader{}
+	peb.Err = ec.UnmarshalBinary(buf)
+	if peb.Err != nil {
+		return peb
+	}
+	peb.EC = ec
+	vidEnd := int(ec.VIDHdrOffset) + VIDHdrSize
+	if vidEnd > len(buf) || int(ec.DataOffset) < vidEnd || int(ec.DataOffset) > len(buf) {
+		peb.Err = fmt.Errorf("EC header: bad offsets VID 0x%x data 0x%x", ec.VIDHdrOffset, ec.DataOffset)
+		return peb
+	}
+	if mtdabi.IsErased(buf[ec.VIDHdrOffset:vidEnd]) {
+		peb.State = PEBFree
+		return peb
+	}
+	vid := &VIDHeader{}
+	peb.Err = vid.UnmarshalBinary(buf[ec.VIDHdrOffset:])
+	if peb.Err != nil {
+		return peb
+	}
+	peb.State = PEBUsed
+	peb.VID = vid
+	if vid.VolType == VIDStatic || vid.CopyFlag != 0 {
+		data := buf[ec.DataOffset:]
+		if int(vid.DataSize) > len(data) {
+			peb.Err = fmt.Errorf("data size %v larger than LEB", vid.DataSize)
+		} else if got := crc(data[:vid.DataSize]); got != vid.DataCRC {
+			peb.Err = fmt.Errorf("data: %w 0x%08x, want 0x%08x", ErrBadCRC, got, vid.DataCRC)
+		}
+	}
+	return peb
+}
+
+// resolve records PEB num as the holder of its LEB if it is newer than the
+// PEB recorded so far. PEBs whose data failed the CRC check only win over
+// PEBs that also failed it.
+func (img *Image) resolve(num int) {
+	peb := &img.PEBs[num]
+	if peb.State != PEBUsed {
+		return
+	}
+	vol := img.lebs[peb.VID.VolID]
+	if vol == nil {
+		vol = make(map[int]int)
+		img.lebs[peb.VID.VolID] = vol
+	}
+	lnum := int(peb.VID.Lnum)
+	prevNum, ok := vol[lnum]
+	if ok {
+		prev := &img.PEBs[prevNum]
+		if (peb.Err == nil) == (prev.Err == nil) {
+			if peb.VID.Sqnum < prev.VID.Sqnum {
+				return
+			}
+		} else if peb.Err != nil {
+			return
+		}
+	}
+	vol[lnum] = num
+}
+
+// readVtbl reconstructs the volume table from either copy held by the layout
+// volume.
+func (img *Image) readVtbl() {
+	var records []VtblRecord
+	for lnum := 0; lnum < LayoutVolumeEBS; lnum++ {
+		buf, err := img.ReadLEB(LayoutVolumeID, lnum)
+		if err == nil {
+			records, err = UnmarshalVtbl(buf)
+		}
+		if err == nil {
+			img.VtblErr = nil
+			break
+		}
+		img.VtblErr = fmt.Errorf("volume table copy %v: %w", lnum, err)
+	}
+	for id, record := range records {
+		if record.ReservedPEBs == 0 {
+			continue
+		}
+		vol := &Volume{ID: id, Record: record, LEBs: img.lebs[uint32(id)]}
+		if vol.LEBs == nil {
+			vol.LEBs = make(map[int]int)
+		}
+		img.Volumes = append(img.Volumes, vol)
+	}
+}
+
+// ReadLEB returns the contents of a LEB of a volume: the data area of the PEB
+// holding it, truncated to the data size for static volumes.
+func (img *Image) ReadLEB(volID uint32, lnum int) ([]byte, error) {
+	num, ok := img.lebs[volID][lnum]
+	if !ok {
+		return nil, fmt.Errorf("LEB %v of volume %v not mapped", lnum, volID)
+	}
+	peb := img.PEBs[num]
+	size := img.PEBSize - int(peb.EC.DataOffset)
+	if peb.VID.VolType == VIDStatic {
+		size = int(peb.VID.DataSize)
+	}
+	buf := make([]byte, size)
+	_, err := img.r.ReadAt(buf, int64(num)*int64(img.PEBSize)+int64(peb.EC.DataOffset))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteReport writes a human-readable summary of the image to w: PEB states
+// and erase counters, the LEB to PEB mapping of every volume, and the
+// problems found.
+func (img *Image) WriteReport(w io.Writer) error {
+	counts := make(map[PEBState]int)
+	var ecMin, ecMax, ecSum uint64
+	ecCount := 0
+	for _, peb := range img.PEBs {
+		counts[peb.State]++
+		if peb.EC == nil {
+			continue
+		}
+		if ecCount == 0 || peb.EC.EC < ecMin {
+			ecMin = peb.EC.EC
+		}
+		if peb.EC.EC > ecMax {
+			ecMax = peb.EC.EC
+		}
+		ecSum += peb.EC.EC
+		ecCount++
+	}
+	ew := &errWriter{w: w}
+	ew.printf("%d PEBs of 0x%x bytes: %d used, %d free, %d empty, %d corrupt\n",
+		len(img.PEBs), img.PEBSize, counts[PEBUsed], counts[PEBFree], counts[PEBEmpty], counts[PEBCorrupt])
+	if ecCount > 0 {
+		ew.printf("erase counters: min %d, max %d, mean %.2f\n", ecMin, ecMax, float64(ecSum)/float64(ecCount))
+	}
+	if img.VtblErr != nil {
+		ew.printf("volume table: %v\n", img.VtblErr)
+	}
+	for _, vol := range img.Volumes {
+		kind := "dynamic"
+		if vol.Record.VolType == VIDStatic {
+			kind = "static"
+		}
+		ew.printf("volume %d %q: %s, %d reserved PEBs, %d LEBs mapped\n",
+			vol.ID, vol.Record.Name, kind, vol.Record.ReservedPEBs, len(vol.LEBs))
+		lnums := make([]int, 0, len(vol.LEBs))
+		for lnum := range vol.LEBs {
+			lnums = append(lnums, lnum)
+		}
+		sort.Ints(lnums)
+		for _, lnum := range lnums {
+			num := vol.LEBs[lnum]
+			ew.printf("  LEB %d -> PEB %d (EC %d)\n", lnum, num, img.PEBs[num].EC.EC)
+		}
+	}
+	for _, peb := range img.PEBs {
+		if peb.Err != nil {
+			ew.printf("PEB %d: %v\n", peb.Num, peb.Err)
+		}
+	}
+	return ew.err
+}
+
+// errWriter formats to w until the first error.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
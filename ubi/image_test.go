@@ -0,0 +1,143 @@
+package ubi
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testPEBSize      = 0x4000
+	testVIDHdrOffset = 0x200
+	testDataOffset   = 0x400
+)
+
+// testPEB returns a PEB with the given erase counter, an optional VID header
+// and data.
+func testPEB(t *testing.T, ec uint64, vid *VIDHeader, data []byte) []byte {
+	peb := bytes.Repeat([]byte{0xff}, testPEBSize)
+	hdr, err := (&ECHeader{Version: Version, EC: ec, VIDHdrOffset: testVIDHdrOffset, DataOffset: testDataOffset, ImageSeq: 1}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	copy(peb, hdr)
+	if vid != nil {
+		hdr, err = vid.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		copy(peb[testVIDHdrOffset:], hdr)
+	}
+	copy(peb[testDataOffset:], data)
+	return peb
+}
+
+// testVtbl returns a volume table LEB holding records.
+func testVtbl(t *testing.T, records map[int]VtblRecord) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < vtblRecords(testPEBSize-testDataOffset); i++ {
+		record := records[i]
+		rec, err := record.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		buf.Write(rec)
+	}
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	records := map[int]VtblRecord{
+		0: {ReservedPEBs: 2, Alignment: 1, VolType: VIDDynamic, Name: "rootfs"},
+		3: {ReservedPEBs: 1, Alignment: 1, VolType: VIDStatic, Name: "kernel"},
+	}
+	vtbl := testVtbl(t, records)
+	kernel := []byte("kernel image")
+	badKernel := []byte("kernel imagf")
+
+	layout := func(lnum uint32, sqnum uint64) *VIDHeader {
+		return &VIDHeader{Version: Version, VolType: VIDDynamic, VolID: LayoutVolumeID, Lnum: lnum, Sqnum: sqnum}
+	}
+	static := &VIDHeader{Version: Version, VolType: VIDStatic, VolID: 3, DataSize: uint32(len(kernel)), UsedEBs: 1, DataCRC: crc(kernel), Sqnum: 4}
+	corruptVtbl := append([]byte(nil), vtbl...)
+	corruptVtbl[20] ^= 1
+
+	image := bytes.Join([][]byte{
+		testPEB(t, 3, layout(0, 1), corruptVtbl),
+		testPEB(t, 3, layout(1, 2), vtbl),
+		testPEB(t, 5, &VIDHeader{Version: Version, VolType: VIDDynamic, VolID: 0, Lnum: 0, Sqnum: 20}, []byte("new")),
+		testPEB(t, 4, &VIDHeader{Version: Version, VolType: VIDDynamic, VolID: 0, Lnum: 0, Sqnum: 10}, []byte("old")),
+		testPEB(t, 2, static, kernel),
+		// A newer copy of the static LEB, interrupted by a power cut
+		testPEB(t, 2, &VIDHeader{Version: Version, VolType: VIDStatic, VolID: 3, CopyFlag: 1, DataSize: uint32(len(kernel)), UsedEBs: 1, DataCRC: crc(kernel), Sqnum: 30}, badKernel),
+		testPEB(t, 1, nil, nil),
+		bytes.Repeat([]byte{0xff}, testPEBSize),
+		bytes.Repeat([]byte{0x00}, testPEBSize),
+	}, nil)
+
+	img, err := Parse(bytes.NewReader(image), int64(len(image)), testPEBSize)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	wantStates := []PEBState{PEBUsed, PEBUsed, PEBUsed, PEBUsed, PEBUsed, PEBUsed, PEBFree, PEBEmpty, PEBCorrupt}
+	for i, peb := range img.PEBs {
+		if peb.State != wantStates[i] {
+			t.Errorf("PEB %v state: want '%v' got '%v'", i, wantStates[i], peb.State)
+		}
+	}
+	if !errors.Is(img.PEBs[5].Err, ErrBadCRC) {
+		t.Errorf("PEB 5 err: want '%v' got '%v'", ErrBadCRC, img.PEBs[5].Err)
+	}
+
+	if img.VtblErr != nil {
+		t.Fatalf("VtblErr: %v", img.VtblErr)
+	}
+	if len(img.Volumes) != 2 {
+		t.Fatalf("Volumes: want 2 got %v", len(img.Volumes))
+	}
+	if img.Volumes[0].Record.Name != "rootfs" || !reflect.DeepEqual(img.Volumes[0].LEBs, map[int]int{0: 2}) {
+		t.Errorf("Volume 0: got '%+v'", img.Volumes[0])
+	}
+	if img.Volumes[1].ID != 3 || !reflect.DeepEqual(img.Volumes[1].LEBs, map[int]int{0: 4}) {
+		t.Errorf("Volume 3: got '%+v'", img.Volumes[1])
+	}
+	leb, err := img.ReadLEB(3, 0)
+	if err != nil {
+		t.Fatalf("ReadLEB failed: %v", err)
+	}
+	if !bytes.Equal(leb, kernel) {
+		t.Errorf("LEB: want '%q' got '%q'", kernel, leb)
+	}
+
+	var report strings.Builder
+	err = img.WriteReport(&report)
+	if err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	for _, want := range []string{
+		"9 PEBs of 0x4000 bytes: 6 used, 1 free, 1 empty, 1 corrupt",
+		"erase counters: min 1, max 5",
+		`volume 0 "rootfs": dynamic, 2 reserved PEBs, 1 LEBs mapped`,
+		"  LEB 0 -> PEB 2 (EC 5)",
+		"PEB 8: EC header: bad magic",
+	} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("Report: want '%v' in:\n%v", want, report.String())
+		}
+	}
+}
+
+func TestHeaderCRC(t *testing.T) {
+	buf, err := (&VIDHeader{Version: Version, VolID: 1}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	buf[12] ^= 1
+	err = (&VIDHeader{}).UnmarshalBinary(buf)
+	if !errors.Is(err, ErrBadCRC) {
+		t.Errorf("UnmarshalBinary err: want '%v' got '%v'", ErrBadCRC, err)
+	}
+}
@@ -0,0 +1,240 @@
+package ubi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// On-flash format of UBI, as defined in
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/drivers/mtd/ubi/ubi-media.h.
+// All integers are big-endian.
+const (
+	// ECHdrMagic is the magic of erase counter headers ("UBI#")
+	ECHdrMagic = 0x55424923
+	// VIDHdrMagic is the magic of volume identifier headers ("UBI!")
+	VIDHdrMagic = 0x55424921
+	// Version is the UBI on-flash format version
+	Version = 1
+
+	// ECHdrSize is the size of an erase counter header
+	ECHdrSize = 64
+	// VIDHdrSize is the size of a volume identifier header
+	VIDHdrSize = 64
+	// VtblRecordSize is the size of a volume table record
+	VtblRecordSize = 172
+	// MaxVolumes is the maximum number of user volumes
+	MaxVolumes = 128
+
+	// LayoutVolumeID is the ID of the internal volume holding the volume table
+	LayoutVolumeID = 0x7fffefff
+	// LayoutVolumeEBS is the number of LEBs of the layout volume
+	LayoutVolumeEBS = 2
+)
+
+// Volume types of VID headers and volume table records, which differ from
+// those of MkvolReq
+const (
+	VIDDynamic = 1
+	VIDStatic  = 2
+)
+
+// ErrBadCRC is wrapped by errors for headers and records whose CRC does not
+// match their contents.
+var ErrBadCRC = errors.New("bad CRC")
+
+// crc computes the CRC-32 used by UBI, which starts from 0xFFFFFFFF like
+// CRC-32 (IEEE) but omits the final inversion.
+func crc(buf []byte) uint32 {
+	return ^crc32.ChecksumIEEE(buf)
+}
+
+// ECHeader is an erase counter header, found at the start of every PEB in use.
+//
+//	struct ubi_ec_hdr
+type ECHeader struct {
+	Version      uint8
+	EC           uint64
+	VIDHdrOffset uint32
+	DataOffset   uint32
+	ImageSeq     uint32
+}
+
+// MarshalBinary encodes the header, computing its CRC.
+func (h *ECHeader) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, ECHdrSize)
+	binary.BigEndian.PutUint32(buf[0:], ECHdrMagic)
+	buf[4] = h.Version
+	binary.BigEndian.PutUint64(buf[8:], h.EC)
+	binary.BigEndian.PutUint32(buf[16:], h.VIDHdrOffset)
+	binary.BigEndian.PutUint32(buf[20:], h.DataOffset)
+	binary.BigEndian.PutUint32(buf[24:], h.ImageSeq)
+	binary.BigEndian.PutUint32(buf[60:], crc(buf[:60]))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the header, checking its magic and CRC.
+func (h *ECHeader) UnmarshalBinary(buf []byte) error {
+	if len(buf) < ECHdrSize {
+		return fmt.Errorf("EC header: %v bytes, want %v", len(buf), ECHdrSize)
+	}
+	if magic := binary.BigEndian.Uint32(buf); magic != ECHdrMagic {
+		return fmt.Errorf("EC header: bad magic 0x%08x", magic)
+	}
+	if got, want := crc(buf[:60]), binary.BigEndian.Uint32(buf[60:]); got != want {
+		return fmt.Errorf("EC header: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	*h = ECHeader{
+		Version:      buf[4],
+		EC:           binary.BigEndian.Uint64(buf[8:]),
+		VIDHdrOffset: binary.BigEndian.Uint32(buf[16:]),
+		DataOffset:   binary.BigEndian.Uint32(buf[20:]),
+		ImageSeq:     binary.BigEndian.Uint32(buf[24:]),
+	}
+	return nil
+}
+
+// VIDHeader is a volume identifier header, telling which LEB of which volume
+// a PEB holds.
+//
+//	struct ubi_vid_hdr
+type VIDHeader struct {
+	Version  uint8
+	VolType  uint8
+	CopyFlag uint8
+	Compat   uint8
+	VolID    uint32
+	Lnum     uint32
+	DataSize uint32
+	UsedEBs  uint32
+	DataPad  uint32
+	DataCRC  uint32
+	Sqnum    uint64
+}
+
+// MarshalBinary encodes the header, computing its CRC.
+func (h *VIDHeader) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, VIDHdrSize)
+	binary.BigEndian.PutUint32(buf[0:], VIDHdrMagic)
+	buf[4] = h.Version
+	buf[5] = h.VolType
+	buf[6] = h.CopyFlag
+	buf[7] = h.Compat
+	binary.BigEndian.PutUint32(buf[8:], h.VolID)
+	binary.BigEndian.PutUint32(buf[12:], h.Lnum)
+	binary.BigEndian.PutUint32(buf[20:], h.DataSize)
+	binary.BigEndian.PutUint32(buf[24:], h.UsedEBs)
+	binary.BigEndian.PutUint32(buf[28:], h.DataPad)
+	binary.BigEndian.PutUint32(buf[32:], h.DataCRC)
+	binary.BigEndian.PutUint64(buf[40:], h.Sqnum)
+	binary.BigEndian.PutUint32(buf[60:], crc(buf[:60]))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the header, checking its magic and CRC.
+func (h *VIDHeader) UnmarshalBinary(buf []byte) error {
+	if len(buf) < VIDHdrSize {
+		return fmt.Errorf("VID header: %v bytes, want %v", len(buf), VIDHdrSize)
+	}
+	if magic := binary.BigEndian.Uint32(buf); magic != VIDHdrMagic {
+		return fmt.Errorf("VID header: bad magic 0x%08x", magic)
+	}
+	if got, want := crc(buf[:60]), binary.BigEndian.Uint32(buf[60:]); got != want {
+		return fmt.Errorf("VID header: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	*h = VIDHeader{
+		Version:  buf[4],
+		VolType:  buf[5],
+		CopyFlag: buf[6],
+		Compat:   buf[7],
+		VolID:    binary.BigEndian.Uint32(buf[8:]),
+		Lnum:     binary.BigEndian.Uint32(buf[12:]),
+		DataSize: binary.BigEndian.Uint32(buf[20:]),
+		UsedEBs:  binary.BigEndian.Uint32(buf[24:]),
+		DataPad:  binary.BigEndian.Uint32(buf[28:]),
+		DataCRC:  binary.BigEndian.Uint32(buf[32:]),
+		Sqnum:    binary.BigEndian.Uint64(buf[40:]),
+	}
+	return nil
+}
+
+// VtblRecord is a record of the volume table, describing one volume. Unused
+// records have ReservedPEBs == 0.
+//
+//	struct ubi_vtbl_record
+type VtblRecord struct {
+	ReservedPEBs uint32
+	Alignment    uint32
+	DataPad      uint32
+	VolType      uint8
+	UpdMarker    uint8
+	Name         string
+	Flags        uint8
+}
+
+// MarshalBinary encodes the record, computing its CRC.
+func (r *VtblRecord) MarshalBinary() ([]byte, error) {
+	if len(r.Name) > MaxVolumeName {
+		return nil, fmt.Errorf("volume name %q longer than %v", r.Name, MaxVolumeName)
+	}
+	buf := make([]byte, VtblRecordSize)
+	binary.BigEndian.PutUint32(buf[0:], r.ReservedPEBs)
+	binary.BigEndian.PutUint32(buf[4:], r.Alignment)
+	binary.BigEndian.PutUint32(buf[8:], r.DataPad)
+	buf[12] = r.VolType
+	buf[13] = r.UpdMarker
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(r.Name)))
+	copy(buf[16:], r.Name)
+	buf[144] = r.Flags
+	binary.BigEndian.PutUint32(buf[168:], crc(buf[:168]))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the record, checking its CRC.
+func (r *VtblRecord) UnmarshalBinary(buf []byte) error {
+	if len(buf) < VtblRecordSize {
+		return fmt.Errorf("volume table record: %v bytes, want %v", len(buf), VtblRecordSize)
+	}
+	if got, want := crc(buf[:168]), binary.BigEndian.Uint32(buf[168:]); got != want {
+		return fmt.Errorf("volume table record: %w 0x%08x, want 0x%08x", ErrBadCRC, got, want)
+	}
+	nameLen := int(binary.BigEndian.Uint16(buf[14:]))
+	if nameLen > MaxVolumeName {
+		return fmt.Errorf("volume table record: name length %v", nameLen)
+	}
+	*r = VtblRecord{
+		ReservedPEBs: binary.BigEndian.Uint32(buf[0:]),
+		Alignment:    binary.BigEndian.Uint32(buf[4:]),
+		DataPad:      binary.BigEndian.Uint32(buf[8:]),
+		VolType:      buf[12],
+		UpdMarker:    buf[13],
+		Name:         string(buf[16 : 16+nameLen]),
+		Flags:        buf[144],
+	}
+	return nil
+}
+
+// vtblRecords returns the number of volume table records fitting in a LEB of
+// lebSize bytes.
+func vtblRecords(lebSize int) int {
+	n := lebSize / VtblRecordSize
+	if n > MaxVolumes {
+		n = MaxVolumes
+	}
+	return n
+}
+
+// UnmarshalVtbl decodes a volume table from the contents of a LEB of the
+// layout volume, returning all records including the unused ones.
+func UnmarshalVtbl(buf []byte) ([]VtblRecord, error) {
+	n := vtblRecords(len(buf))
+	records := make([]VtblRecord, n)
+	for i := range records {
+		err := records[i].UnmarshalBinary(buf[i*VtblRecordSize:])
+		if err != nil {
+			return nil, fmt.Errorf("volume %v: %w", i, err)
+		}
+	}
+	return records, nil
+}
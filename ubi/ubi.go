@@ -0,0 +1,289 @@
+// Package ubi is a Golang implementation of helper functions for the `ioctl`
+// calls in the Linux UBI user-space ABI found at
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/uapi/mtd/ubi-user.h.
+//
+// UBI devices are attached to MTD devices through the UBI control device
+// (`/dev/ubi_ctrl`); volumes are managed through UBI device character devices
+// (`/dev/ubiX`) and accessed through UBI volume character devices
+// (`/dev/ubiX_Y`).
+//
+// This package is currently based on version `v5.12` of the Linux kernel.
+package ubi
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// CtrlPath is the path of the UBI control character device.
+const CtrlPath = "/dev/ubi_ctrl"
+
+const (
+	// VolNumAuto lets UBI assign the volume ID (UBI_VOL_NUM_AUTO)
+	VolNumAuto = -1
+	// DevNumAuto lets UBI assign the UBI device number (UBI_DEV_NUM_AUTO)
+	DevNumAuto = -1
+	// MaxVolumeName is the maximum length of a volume name (UBI_MAX_VOLUME_NAME)
+	MaxVolumeName = 127
+	// MaxRnvol is the maximum number of volumes renamed at once (UBI_MAX_RNVOL)
+	MaxRnvol = 32
+)
+
+// Volume types (enum ubi_vol_type)
+const (
+	DynamicVolume = 3
+	StaticVolume  = 4
+)
+
+// Volume flags (enum ubi_mkvol_req.flags)
+const (
+	// VolSkipCRCCheckFlg skips the CRC check of static volumes on open
+	VolSkipCRCCheckFlg = 0x1
+)
+
+// Volume properties (enum ubi_set_vol_prop_req.property)
+const (
+	// VolPropDirectWrite allows LEB writes through the volume character device
+	VolPropDirectWrite = 1
+)
+
+// AttachReq is the request of UBI_IOCATT.
+//
+//	struct ubi_attach_req
+type AttachReq struct {
+	UbiNum        int32
+	MtdNum        int32
+	VidHdrOffset  int32
+	MaxBebPer1024 int16
+	Padding       [10]int8
+}
+
+// MkvolReq is the request of UBI_IOCMKVOL.
+//
+//	struct ubi_mkvol_req
+type MkvolReq struct {
+	VolID     int32
+	Alignment int32
+	Bytes     int64
+	VolType   int8
+	Flags     uint8
+	NameLen   int16
+	Padding2  [4]int8
+	Name      [MaxVolumeName + 1]byte
+}
+
+// SetName sets Name and NameLen.
+func (r *MkvolReq) SetName(name string) error {
+	return setName(r.Name[:], &r.NameLen, name)
+}
+
+// RsvolReq is the request of UBI_IOCRSVOL. The kernel structure is packed to
+// 12 bytes; the trailing padding of the Go structure is not copied.
+//
+//	struct ubi_rsvol_req
+type RsvolReq struct {
+	Bytes int64
+	VolID int32
+}
+
+// RnvolEnt is an entry of RnvolReq.
+type RnvolEnt struct {
+	VolID    int32
+	NameLen  int16
+	Padding2 [2]int8
+	Name     [MaxVolumeName + 1]byte
+}
+
+// SetName sets Name and NameLen.
+func (e *RnvolEnt) SetName(name string) error {
+	return setName(e.Name[:], &e.NameLen, name)
+}
+
+// RnvolReq is the request of UBI_IOCRNVOL, renaming up to MaxRnvol volumes
+// atomically.
+//
+//	struct ubi_rnvol_req
+type RnvolReq struct {
+	Count    int32
+	Padding1 [12]int8
+	Ents     [MaxRnvol]RnvolEnt
+}
+
+// LebChangeReq is the request of UBI_IOCEBCH.
+//
+//	struct ubi_leb_change_req
+type LebChangeReq struct {
+	Lnum  int32
+	Bytes int32
+	// Dtype is obsolete and must be 0
+	Dtype   int8
+	Padding [7]int8
+}
+
+// MapReq is the request of UBI_IOCEBMAP.
+//
+//	struct ubi_map_req
+type MapReq struct {
+	Lnum int32
+	// Dtype is obsolete and must be 0
+	Dtype   int8
+	Padding [3]int8
+}
+
+// SetVolPropReq is the request of UBI_IOCSETVOLPROP.
+//
+//	struct ubi_set_vol_prop_req
+type SetVolPropReq struct {
+	Property uint8
+	Padding  [7]uint8
+	Value    uint64
+}
+
+// ioctl magic numbers of ubi-user.h
+const (
+	ubiIocMagic     = 'o'
+	ubiCtrlIocMagic = 'o'
+	ubiVolIocMagic  = 'O'
+)
+
+// ioctl request numbers, as defined by the _IOW and _IOR macros of ubi-user.h.
+// The sizes are those of the packed kernel structures.
+var (
+	// UBI character device requests
+	iocMkvol = ioc(iocWrite, ubiIocMagic, 0, unsafe.Sizeof(MkvolReq{}))
+	iocRmvol = ioc(iocWrite, ubiIocMagic, 1, 4)
+	iocRsvol = ioc(iocWrite, ubiIocMagic, 2, 12)
+	iocRnvol = ioc(iocWrite, ubiIocMagic, 3, unsafe.Sizeof(RnvolReq{}))
+
+	// UBI control character device requests
+	iocAtt = ioc(iocWrite, ubiCtrlIocMagic, 64, unsafe.Sizeof(AttachReq{}))
+	iocDet = ioc(iocWrite, ubiCtrlIocMagic, 65, 4)
+
+	// UBI volume character device requests
+	iocVolup      = ioc(iocWrite, ubiVolIocMagic, 0, 8)
+	iocEber       = ioc(iocWrite, ubiVolIocMagic, 1, 4)
+	iocEbch       = ioc(iocWrite, ubiVolIocMagic, 2, 4)
+	iocEbmap      = ioc(iocWrite, ubiVolIocMagic, 3, unsafe.Sizeof(MapReq{}))
+	iocEbunmap    = ioc(iocWrite, ubiVolIocMagic, 4, 4)
+	iocEbismap    = ioc(iocRead, ubiVolIocMagic, 5, 4)
+	iocSetvolprop = ioc(iocWrite, ubiVolIocMagic, 6, unsafe.Sizeof(SetVolPropReq{}))
+)
+
+// Attach attaches an MTD device to UBI; on success value.UbiNum holds the
+// number of the new UBI device. fd must point to the UBI control device.
+//
+// #define UBI_IOCATT _IOW(UBI_CTRL_IOC_MAGIC, 64, struct ubi_attach_req)
+func Attach(fd uintptr, value *AttachReq) error {
+	return ioctl(fd, iocAtt, uintptr(unsafe.Pointer(value)))
+}
+
+// Detach detaches the UBI device with the given number from its MTD device.
+// fd must point to the UBI control device.
+//
+// #define UBI_IOCDET _IOW(UBI_CTRL_IOC_MAGIC, 65, __s32)
+func Detach(fd uintptr, value *int32) error {
+	return ioctl(fd, iocDet, uintptr(unsafe.Pointer(value)))
+}
+
+// MkVol creates a volume; on success value.VolID holds the ID of the new
+// volume. fd must point to a UBI device.
+//
+// #define UBI_IOCMKVOL _IOW(UBI_IOC_MAGIC, 0, struct ubi_mkvol_req)
+func MkVol(fd uintptr, value *MkvolReq) error {
+	return ioctl(fd, iocMkvol, uintptr(unsafe.Pointer(value)))
+}
+
+// RmVol removes the volume with the given ID. fd must point to a UBI device.
+//
+// #define UBI_IOCRMVOL _IOW(UBI_IOC_MAGIC, 1, __s32)
+func RmVol(fd uintptr, value *int32) error {
+	return ioctl(fd, iocRmvol, uintptr(unsafe.Pointer(value)))
+}
+
+// RsVol re-sizes a volume. fd must point to a UBI device.
+//
+// #define UBI_IOCRSVOL _IOW(UBI_IOC_MAGIC, 2, struct ubi_rsvol_req)
+func RsVol(fd uintptr, value *RsvolReq) error {
+	return ioctl(fd, iocRsvol, uintptr(unsafe.Pointer(value)))
+}
+
+// RnVol renames volumes atomically. fd must point to a UBI device.
+//
+// #define UBI_IOCRNVOL _IOW(UBI_IOC_MAGIC, 3, struct ubi_rnvol_req)
+func RnVol(fd uintptr, value *RnvolReq) error {
+	return ioctl(fd, iocRnvol, uintptr(unsafe.Pointer(value)))
+}
+
+// VolUp starts a volume update of the given number of bytes, which must then
+// be written to the volume; 0 wipes the volume. fd must point to a UBI
+// volume.
+//
+// #define UBI_IOCVOLUP _IOW(UBI_VOL_IOC_MAGIC, 0, __s64)
+func VolUp(fd uintptr, value *int64) error {
+	return ioctl(fd, iocVolup, uintptr(unsafe.Pointer(value)))
+}
+
+// LebErase erases the logical eraseblock with the given number. fd must
+// point to a UBI volume.
+//
+// #define UBI_IOCEBER _IOW(UBI_VOL_IOC_MAGIC, 1, __s32)
+func LebErase(fd uintptr, value *int32) error {
+	return ioctl(fd, iocEber, uintptr(unsafe.Pointer(value)))
+}
+
+// LebChange starts an atomic change of a logical eraseblock; value.Bytes
+// bytes must then be written to the volume. fd must point to a UBI volume.
+//
+// #define UBI_IOCEBCH _IOW(UBI_VOL_IOC_MAGIC, 2, __s32)
+func LebChange(fd uintptr, value *LebChangeReq) error {
+	return ioctl(fd, iocEbch, uintptr(unsafe.Pointer(value)))
+}
+
+// LebMap maps a logical eraseblock to a physical eraseblock. fd must point
+// to a UBI volume.
+//
+// #define UBI_IOCEBMAP _IOW(UBI_VOL_IOC_MAGIC, 3, struct ubi_map_req)
+func LebMap(fd uintptr, value *MapReq) error {
+	return ioctl(fd, iocEbmap, uintptr(unsafe.Pointer(value)))
+}
+
+// LebUnmap unmaps the logical eraseblock with the given number. fd must point
+// to a UBI volume.
+//
+// #define UBI_IOCEBUNMAP _IOW(UBI_VOL_IOC_MAGIC, 4, __s32)
+func LebUnmap(fd uintptr, value *int32) error {
+	return ioctl(fd, iocEbunmap, uintptr(unsafe.Pointer(value)))
+}
+
+// LebIsMapped checks if the logical eraseblock with the given number is
+// mapped, which the kernel returns as the ioctl return value. fd must point
+// to a UBI volume.
+//
+// #define UBI_IOCEBISMAP _IOR(UBI_VOL_IOC_MAGIC, 5, __s32)
+func LebIsMapped(fd uintptr, value *int32) (bool, error) {
+	r, err := ioctlRet(fd, iocEbismap, uintptr(unsafe.Pointer(value)))
+	if err != nil {
+		return false, err
+	}
+	return r == 1, nil
+}
+
+// SetVolProp sets a volume property. fd must point to a UBI volume.
+//
+// #define UBI_IOCSETVOLPROP _IOW(UBI_VOL_IOC_MAGIC, 6, struct ubi_set_vol_prop_req)
+func SetVolProp(fd uintptr, value *SetVolPropReq) error {
+	return ioctl(fd, iocSetvolprop, uintptr(unsafe.Pointer(value)))
+}
+
+// setName copies name into the NUL-terminated buffer buf and sets *nameLen.
+func setName(buf []byte, nameLen *int16, name string) error {
+	if len(name) == 0 || len(name) > MaxVolumeName {
+		return fmt.Errorf("volume name %q: length %v not in [1, %v]", name, len(name), MaxVolumeName)
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	copy(buf, name)
+	*nameLen = int16(len(name))
+	return nil
+}
@@ -0,0 +1,75 @@
+package ubi
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// Tests the sizes of the structures against those of the kernel
+func TestStructSizes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"ubi_attach_req", unsafe.Sizeof(AttachReq{}), 24},
+		{"ubi_mkvol_req", unsafe.Sizeof(MkvolReq{}), 152},
+		{"ubi_rnvol_req", unsafe.Sizeof(RnvolReq{}), 4368},
+		{"ubi_leb_change_req", unsafe.Sizeof(LebChangeReq{}), 16},
+		{"ubi_map_req", unsafe.Sizeof(MapReq{}), 8},
+		{"ubi_set_vol_prop_req", unsafe.Sizeof(SetVolPropReq{}), 16},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("sizeof(struct %v): want '%v' got '%v'", tc.name, tc.want, tc.got)
+		}
+	}
+}
+
+// Tests the request numbers against those of the kernel on architectures
+// using the generic ioctl encoding
+func TestRequestNumbers(t *testing.T) {
+	switch runtime.GOARCH {
+	case "386", "amd64", "arm", "arm64", "riscv64":
+	default:
+		t.Skipf("ioctl encoding of %v not covered", runtime.GOARCH)
+	}
+	for _, tc := range []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"UBI_IOCMKVOL", iocMkvol, 0x40986f00},
+		{"UBI_IOCRMVOL", iocRmvol, 0x40046f01},
+		{"UBI_IOCRSVOL", iocRsvol, 0x400c6f02},
+		{"UBI_IOCRNVOL", iocRnvol, 0x51106f03},
+		{"UBI_IOCATT", iocAtt, 0x40186f40},
+		{"UBI_IOCDET", iocDet, 0x40046f41},
+		{"UBI_IOCVOLUP", iocVolup, 0x40084f00},
+		{"UBI_IOCEBER", iocEber, 0x40044f01},
+		{"UBI_IOCEBCH", iocEbch, 0x40044f02},
+		{"UBI_IOCEBMAP", iocEbmap, 0x40084f03},
+		{"UBI_IOCEBUNMAP", iocEbunmap, 0x40044f04},
+		{"UBI_IOCEBISMAP", iocEbismap, 0x80044f05},
+		{"UBI_IOCSETVOLPROP", iocSetvolprop, 0x40104f06},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%v: want '0x%x' got '0x%x'", tc.name, tc.want, tc.got)
+		}
+	}
+}
+
+func TestSetName(t *testing.T) {
+	var req MkvolReq
+	err := req.SetName("rootfs")
+	if err != nil {
+		t.Fatalf("SetName failed: %v", err)
+	}
+	if req.NameLen != 6 || string(req.Name[:7]) != "rootfs\x00" {
+		t.Errorf("Name: got '%q' (%v)", req.Name[:7], req.NameLen)
+	}
+	err = req.SetName(string(make([]byte, MaxVolumeName+1)))
+	if err == nil {
+		t.Errorf("SetName: want error for too long name")
+	}
+}
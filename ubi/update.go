@@ -0,0 +1,175 @@
+package ubi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysfsRoot is the sysfs directory holding one directory per UBI device and
+// volume.
+const SysfsRoot = "/sys/class/ubi"
+
+// Errors of Updater, to be tested with errors.Is.
+var (
+	// ErrTooLong means more bytes were written than announced.
+	ErrTooLong = errors.New("update longer than announced")
+	// ErrShortUpdate means the updater was closed before all announced bytes
+	// were written.
+	ErrShortUpdate = errors.New("update shorter than announced")
+)
+
+// Updater streams new contents to a UBI volume after UBI_IOCVOLUP or
+// UBI_IOCEBCH, enforcing that exactly the announced number of bytes is
+// written. It must be closed; Close reports a short stream.
+//
+// If a volume update is not completed, UBI keeps the volume marked as being
+// updated and refuses to read it until a new update succeeds. If an atomic
+// LEB change is not completed, the LEB keeps its previous contents.
+type Updater struct {
+	file      *os.File
+	size      int64
+	remaining int64
+	err       error
+}
+
+// OpenVolumeUpdate opens the UBI volume character device at path (e.g.,
+// `/dev/ubi0_1`) and starts replacing its contents with size bytes, using
+// UBI_IOCVOLUP.
+func OpenVolumeUpdate(path string, size int64) (*Updater, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = VolUp(file.Fd(), &size)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("UBI_IOCVOLUP failed on '%v': %w", path, err)
+	}
+	return newUpdater(file, size), nil
+}
+
+// OpenLebChange opens the UBI volume character device at path and starts an
+// atomic change of LEB lnum to size bytes, using UBI_IOCEBCH. Either all of
+// the new contents become visible on Close, or none. This only works for
+// dynamic volumes, and size must not exceed the LEB size of the volume.
+func OpenLebChange(path string, lnum int32, size int32) (*Updater, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	req := LebChangeReq{Lnum: lnum, Bytes: size}
+	err = LebChange(file.Fd(), &req)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("UBI_IOCEBCH failed on '%v': %w", path, err)
+	}
+	return newUpdater(file, int64(size)), nil
+}
+
+// newUpdater returns an Updater expecting size bytes to be written to file.
+func newUpdater(file *os.File, size int64) *Updater {
+	return &Updater{file: file, size: size, remaining: size}
+}
+
+// Write writes p to the volume. Bytes past the announced size are not
+// written, and make Write fail with ErrTooLong.
+func (u *Updater) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	var tooLong bool
+	if int64(len(p)) > u.remaining {
+		p = p[:u.remaining]
+		tooLong = true
+	}
+	n, err := u.file.Write(p)
+	u.remaining -= int64(n)
+	if err != nil {
+		u.err = err
+		return n, err
+	}
+	if tooLong {
+		u.err = fmt.Errorf("%w: %v bytes", ErrTooLong, u.size)
+		return n, u.err
+	}
+	return n, nil
+}
+
+// Close closes the volume, failing with ErrShortUpdate if fewer bytes than
+// announced were written.
+func (u *Updater) Close() error {
+	closeErr := u.file.Close()
+	if u.err != nil {
+		return u.err
+	}
+	if u.remaining > 0 {
+		return fmt.Errorf("%w: %v of %v bytes written", ErrShortUpdate, u.size-u.remaining, u.size)
+	}
+	return closeErr
+}
+
+// UpdateVolume replaces the contents of the UBI volume at path with size
+// bytes read from r. If atomic is set, the volume must consist of a single
+// LEB, which is replaced with an atomic LEB change, so that a power cut leaves
+// either the old or the new contents; otherwise a volume update is used.
+// Volumes of several LEBs are refused for atomic updates, as the LEBs past the
+// first would keep their old contents.
+func UpdateVolume(path string, r io.Reader, size int64, atomic bool) error {
+	var u *Updater
+	var err error
+	if atomic {
+		err = checkAtomicUpdate(SysfsRoot, path, size)
+		if err != nil {
+			return err
+		}
+		u, err = OpenLebChange(path, 0, int32(size))
+	} else {
+		u, err = OpenVolumeUpdate(path, size)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(u, r, size)
+	closeErr := u.Close()
+	if closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// checkAtomicUpdate checks that the UBI volume at path, whose attributes are
+// read from the sysfs directory root, is a single LEB of at least size bytes.
+func checkAtomicUpdate(root, path string, size int64) error {
+	lebs, err := volumeAttr(root, path, "reserved_ebs")
+	if err != nil {
+		return err
+	}
+	if lebs != 1 {
+		return fmt.Errorf("atomic update of volume of %v LEBs: only single-LEB volumes can be updated atomically", lebs)
+	}
+	lebSize, err := volumeAttr(root, path, "usable_eb_size")
+	if err != nil {
+		return err
+	}
+	if size > lebSize {
+		return fmt.Errorf("atomic update of %v bytes larger than LEB size %v", size, lebSize)
+	}
+	return nil
+}
+
+// volumeAttr reads an integer sysfs attribute of the UBI volume at path from
+// the sysfs directory root.
+func volumeAttr(root, path, attr string) (int64, error) {
+	name := filepath.Base(path)
+	buf, err := ioutil.ReadFile(filepath.Join(root, name, attr))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+}
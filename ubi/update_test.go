@@ -0,0 +1,115 @@
+package ubi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestUpdater returns an Updater expecting size bytes, writing to a
+// temporary file instead of a UBI volume.
+func newTestUpdater(t *testing.T, size int64) (*Updater, string) {
+	file, err := ioutil.TempFile("", "ubi-update")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	return newUpdater(file, size), file.Name()
+}
+
+func TestUpdaterExact(t *testing.T) {
+	u, path := newTestUpdater(t, 10)
+	for _, chunk := range []string{"0123", "456", "789"} {
+		_, err := u.Write([]byte(chunk))
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	err := u.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read back: %v", err)
+	}
+	if string(got) != "0123456789" {
+		t.Errorf("Contents: want '%v' got '%v'", "0123456789", string(got))
+	}
+}
+
+func TestUpdaterShort(t *testing.T) {
+	u, _ := newTestUpdater(t, 10)
+	_, err := u.Write([]byte("01234"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	err = u.Close()
+	if !errors.Is(err, ErrShortUpdate) {
+		t.Errorf("Close err: want '%v' got '%v'", ErrShortUpdate, err)
+	}
+}
+
+func TestUpdaterTooLong(t *testing.T) {
+	u, path := newTestUpdater(t, 4)
+	n, err := u.Write([]byte("012345"))
+	if !errors.Is(err, ErrTooLong) || n != 4 {
+		t.Errorf("Write: want 4, '%v' got %v, '%v'", ErrTooLong, n, err)
+	}
+	_, err = u.Write([]byte("6"))
+	if !errors.Is(err, ErrTooLong) {
+		t.Errorf("Write err: want '%v' got '%v'", ErrTooLong, err)
+	}
+	err = u.Close()
+	if !errors.Is(err, ErrTooLong) {
+		t.Errorf("Close err: want '%v' got '%v'", ErrTooLong, err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read back: %v", err)
+	}
+	if string(got) != "0123" {
+		t.Errorf("Contents: want '%v' got '%v'", "0123", string(got))
+	}
+}
+
+func TestCheckAtomicUpdate(t *testing.T) {
+	root, err := ioutil.TempDir("", "ubi-sysfs")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for name, lebs := range map[string]string{"ubi0_0": "1\n", "ubi0_1": "2\n"} {
+		dir := filepath.Join(root, name)
+		err = os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		for attr, value := range map[string]string{"reserved_ebs": lebs, "usable_eb_size": "126976\n"} {
+			err = ioutil.WriteFile(filepath.Join(dir, attr), []byte(value), 0644)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+		}
+	}
+
+	err = checkAtomicUpdate(root, "/dev/ubi0_0", 126976)
+	if err != nil {
+		t.Errorf("Single LEB volume: %v", err)
+	}
+	err = checkAtomicUpdate(root, "/dev/ubi0_0", 126977)
+	if err == nil {
+		t.Errorf("Update larger than the LEB succeeded")
+	}
+	// Only the first LEB would be replaced
+	err = checkAtomicUpdate(root, "/dev/ubi0_1", 100)
+	if err == nil {
+		t.Errorf("Update of a volume of 2 LEBs succeeded")
+	}
+	err = checkAtomicUpdate(root, "/dev/ubi0_2", 100)
+	if !os.IsNotExist(err) {
+		t.Errorf("Missing volume: want not exist got '%v'", err)
+	}
+}
@@ -0,0 +1,175 @@
+// Package ubootenv reads and writes U-Boot environments stored on MTD
+// devices, replacing fw_printenv and fw_setenv.
+//
+// A copy of the environment has the layout of U-Boot's env_t:
+//
+//	offset  size      content
+//	0       4         CRC-32 (IEEE) of the data, in the byte order of the CPU
+//	4       1         flags, in redundant environments only
+//	4 or 5  the rest  data: "name=value" entries, each ended by a NUL, then
+//	                  an empty entry; the rest is padded with NULs
+//
+// A redundant environment has two copies; the valid one with the newest
+// flags is current, and updates are written to the other one. As in U-Boot
+// and fw_env, the flags of copies on NAND count up, while on NOR, whose
+// bytes can be cleared without an erase, the current copy is marked active
+// (1) and the other one obsolete (0).
+package ubootenv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+const (
+	crcSize   = 4
+	flagsSize = 1
+)
+
+// Errors of environments, to be tested with errors.Is.
+var (
+	// ErrBadCRC means a copy of the environment fails its CRC.
+	ErrBadCRC = errors.New("bad environment CRC")
+	// ErrTooLarge means the variables do not fit in a copy.
+	ErrTooLarge = errors.New("environment too large")
+)
+
+// Env holds the variables of an environment by name.
+type Env map[string]string
+
+// Format describes a copy of the environment.
+type Format struct {
+	// Size is the size of a copy, header included, as CONFIG_ENV_SIZE.
+	Size int
+	// Redundant copies have a flags byte after the CRC.
+	Redundant bool
+	// ByteOrder is the byte order of the CRC. Nil means little-endian.
+	ByteOrder binary.ByteOrder
+}
+
+// headerSize returns the size of the header before the data.
+func (f Format) headerSize() int {
+	if f.Redundant {
+		return crcSize + flagsSize
+	}
+	return crcSize
+}
+
+func (f Format) byteOrder() binary.ByteOrder {
+	if f.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return f.ByteOrder
+}
+
+func (f Format) check() error {
+	if f.Size <= f.headerSize()+1 {
+		return fmt.Errorf("invalid environment size %v", f.Size)
+	}
+	return nil
+}
+
+// Decode decodes a copy of the environment, returning its variables and, for
+// redundant copies, its flags.
+func (f Format) Decode(buf []byte) (Env, byte, error) {
+	err := f.check()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < f.Size {
+		return nil, 0, fmt.Errorf("environment of %v bytes, want %v", len(buf), f.Size)
+	}
+	data := buf[f.headerSize():f.Size]
+	if f.byteOrder().Uint32(buf) != crc32.ChecksumIEEE(data) {
+		return nil, 0, ErrBadCRC
+	}
+	var flags byte
+	if f.Redundant {
+		flags = buf[crcSize]
+	}
+	env := make(Env)
+	for len(data) > 0 && data[0] != 0 {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, 0, errors.New("unterminated environment")
+		}
+		entry := string(data[:end])
+		i := strings.IndexByte(entry, '=')
+		if i <= 0 {
+			return nil, 0, fmt.Errorf("invalid environment entry '%v'", entry)
+		}
+		env[entry[:i]] = entry[i+1:]
+		data = data[end+1:]
+	}
+	return env, flags, nil
+}
+
+// Encode encodes env as a copy of the environment, with flags if redundant.
+// Variables are sorted by name, as U-Boot does.
+func (f Format) Encode(env Env, flags byte) ([]byte, error) {
+	err := f.check()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(env))
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return nil, fmt.Errorf("invalid variable name '%v'", name)
+		}
+		if strings.IndexByte(value, 0) >= 0 {
+			return nil, fmt.Errorf("invalid value of variable '%v'", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := make([]byte, f.Size)
+	n := f.headerSize()
+	for _, name := range names {
+		entry := name + "=" + env[name]
+		// Keep room for the entry terminator and the empty entry
+		if n+len(entry)+2 > f.Size {
+			return nil, fmt.Errorf("%w: %v bytes available", ErrTooLarge, f.Size-f.headerSize())
+		}
+		n += copy(buf[n:], entry) + 1
+	}
+	if f.Redundant {
+		buf[crcSize] = flags
+	}
+	f.byteOrder().PutUint32(buf, crc32.ChecksumIEEE(buf[f.headerSize():]))
+	return buf, nil
+}
+
+// newer reports whether a redundant copy with flags a is newer than one with
+// flags b. Flags count up, wrapping from 255 to 0, as in U-Boot on NAND.
+func newer(a, b byte) bool {
+	if a == 0 && b == 0xff {
+		return true
+	}
+	if a == 0xff && b == 0 {
+		return false
+	}
+	return a > b
+}
+
+// Flags of redundant copies on NOR.
+const (
+	flagObsolete = 0
+	flagActive   = 1
+)
+
+// newerBoolean reports whether the second copy of a redundant environment on
+// NOR, with flags a, is newer than the first, with flags b. Like fw_env, an
+// active copy is newer than an obsolete one, and a copy with erased flags
+// newer than any other.
+func newerBoolean(a, b byte) bool {
+	if a == flagActive && b == flagObsolete {
+		return true
+	}
+	return a == 0xff && b != 0xff
+}
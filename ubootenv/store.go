@@ -0,0 +1,274 @@
+package ubootenv
+
+import (
+	"errors"
+	"fmt"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoSpace means the area of a copy has too few good eraseblocks to hold
+// it, to be tested with errors.Is.
+var ErrNoSpace = errors.New("not enough good eraseblocks")
+
+// Location is where a copy of the environment is stored, as in a line of
+// fw_env.config.
+type Location struct {
+	// Offset is the offset of the copy. When the eraseblock containing it is
+	// bad, the copy is at the same offset in the next good eraseblock.
+	Offset int64
+	// Area is the size of the area reserved for the copy, starting at the
+	// eraseblock containing Offset, in which bad eraseblocks are skipped. 0
+	// means just the eraseblocks the copy spans.
+	Area int64
+}
+
+// Store is an environment on a flash: one copy, or two if the format is
+// redundant.
+type Store struct {
+	Flash  mtdabi.Flash
+	Format Format
+	Copies []Location
+}
+
+// Load returns the variables of the current copy. ErrBadCRC means no copy is
+// valid.
+func (s *Store) Load() (Env, error) {
+	env, _, _, err := s.load()
+	return env, err
+}
+
+// load returns the current copy, its index in Copies and its flags.
+func (s *Store) load() (Env, int, byte, error) {
+	err := s.check()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	current := -1
+	var env Env
+	var flags byte
+	for i, loc := range s.Copies {
+		buf, err := s.read(loc)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		e, f, err := s.Format.Decode(buf)
+		if errors.Is(err, ErrBadCRC) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("environment at 0x%x: %w", loc.Offset, err)
+		}
+		if current < 0 || s.newer(f, flags) {
+			current, env, flags = i, e, f
+		}
+	}
+	if current < 0 {
+		return nil, 0, 0, ErrBadCRC
+	}
+	return env, current, flags, nil
+}
+
+// Save writes env. A single copy is erased and rewritten in place. With
+// redundant copies, the copy that is not current is rewritten with newer
+// flags, so a power cut leaves either the old or the new environment. On NOR,
+// the new copy is marked active and then the old one obsolete.
+func (s *Store) Save(env Env) error {
+	_, current, flags, err := s.load()
+	valid := err == nil
+	if errors.Is(err, ErrBadCRC) {
+		current, flags = len(s.Copies)-1, 0
+	} else if err != nil {
+		return err
+	}
+	next := (current + 1) % len(s.Copies)
+	flags++
+	if s.boolean() {
+		flags = flagActive
+	}
+	buf, err := s.Format.Encode(env, flags)
+	if err != nil {
+		return err
+	}
+	err = s.write(s.Copies[next], buf)
+	if err != nil || !s.boolean() || !valid {
+		return err
+	}
+	return s.markObsolete(s.Copies[current])
+}
+
+// Set changes variables like fw_setenv: an empty value deletes the variable.
+// If no copy is valid, it starts from an empty environment.
+func (s *Store) Set(vars map[string]string) error {
+	env, err := s.Load()
+	if errors.Is(err, ErrBadCRC) {
+		env = make(Env)
+	} else if err != nil {
+		return err
+	}
+	for name, value := range vars {
+		if value == "" {
+			delete(env, name)
+		} else {
+			env[name] = value
+		}
+	}
+	return s.Save(env)
+}
+
+// boolean reports whether the flags of redundant copies are boolean, which
+// fw_env decides from the type of the device: NOR, or none for files.
+func (s *Store) boolean() bool {
+	if !s.Format.Redundant {
+		return false
+	}
+	t := s.Flash.Info().Type
+	return t == unix.MTD_NORFLASH || t == unix.MTD_ABSENT
+}
+
+// newer reports whether the second copy, with flags a, is newer than the
+// first, with flags b.
+func (s *Store) newer(a, b byte) bool {
+	if s.boolean() {
+		return newerBoolean(a, b)
+	}
+	return newer(a, b)
+}
+
+// markObsolete clears the flags of the copy at loc to obsolete, without an
+// erase.
+func (s *Store) markObsolete(loc Location) error {
+	blocks, skip, err := s.span(loc)
+	if err != nil {
+		return err
+	}
+	offset := blocks[0].Offset + skip + crcSize
+	_, err = s.Flash.WriteAt([]byte{flagObsolete}, offset)
+	if err != nil {
+		return fmt.Errorf("marking environment at 0x%x obsolete: %w", loc.Offset, err)
+	}
+	return nil
+}
+
+func (s *Store) check() error {
+	err := s.Format.check()
+	if err != nil {
+		return err
+	}
+	want := 1
+	if s.Format.Redundant {
+		want = 2
+	}
+	if len(s.Copies) != want {
+		return fmt.Errorf("%v copies of the environment, want %v", len(s.Copies), want)
+	}
+	return nil
+}
+
+// span returns the good eraseblocks holding the copy at loc, and the offset
+// of the copy in the first one.
+func (s *Store) span(loc Location) ([]mtdabi.Block, int64, error) {
+	g := s.Flash.Geometry()
+	first, err := g.BlockAt(loc.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	skip := loc.Offset - first.Offset
+	need := skip + int64(s.Format.Size)
+	area := loc.Area
+	if area == 0 {
+		area = need
+	}
+	blocks, err := g.Blocks(first.Offset, area)
+	if err != nil {
+		return nil, 0, err
+	}
+	var good []mtdabi.Block
+	var have int64
+	for _, b := range blocks {
+		if have >= need {
+			break
+		}
+		bad, err := s.Flash.IsBad(b.Offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !bad {
+			good = append(good, b)
+			have += b.Size
+		}
+	}
+	if have < need {
+		return nil, 0, fmt.Errorf("environment at 0x%x: %w in 0x%x bytes", loc.Offset, ErrNoSpace, area)
+	}
+	return good, skip, nil
+}
+
+// read reads the copy at loc.
+func (s *Store) read(loc Location) ([]byte, error) {
+	blocks, skip, err := s.span(loc)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := s.readBlocks(blocks)
+	if err != nil {
+		return nil, err
+	}
+	return buf[skip : skip+int64(s.Format.Size)], nil
+}
+
+// write erases the eraseblocks of the copy at loc and writes buf to it,
+// preserving the rest of the eraseblocks.
+func (s *Store) write(loc Location, buf []byte) error {
+	blocks, skip, err := s.span(loc)
+	if err != nil {
+		return err
+	}
+	data, err := s.readBlocks(blocks)
+	if err != nil {
+		return err
+	}
+	copy(data[skip:], buf)
+	pageSize := int64(s.Flash.Info().Writesize)
+	for _, b := range blocks {
+		err = s.Flash.Erase(b.Offset, b.Size)
+		if err != nil {
+			return fmt.Errorf("erasing 0x%x: %w", b.Offset, err)
+		}
+		block := data[:b.Size]
+		data = data[b.Size:]
+		// Erased pages at the end are left alone
+		end := b.Size
+		for end > 0 && mtdabi.IsErased(block[end-pageSize:end]) {
+			end -= pageSize
+		}
+		if end == 0 {
+			continue
+		}
+		_, err = s.Flash.WriteAt(block[:end], b.Offset)
+		if err != nil {
+			return fmt.Errorf("writing 0x%x: %w", b.Offset, err)
+		}
+	}
+	return nil
+}
+
+// readBlocks reads blocks into a single buffer.
+func (s *Store) readBlocks(blocks []mtdabi.Block) ([]byte, error) {
+	var size int64
+	for _, b := range blocks {
+		size += b.Size
+	}
+	buf := make([]byte, size)
+	pos := int64(0)
+	for _, b := range blocks {
+		_, err := s.Flash.ReadAt(buf[pos:pos+b.Size], b.Offset)
+		// Corrected bitflips are fine, and the CRC catches the others
+		if err != nil && err != unix.EUCLEAN && err != unix.EBADMSG {
+			return nil, fmt.Errorf("reading 0x%x: %w", b.Offset, err)
+		}
+		pos += b.Size
+	}
+	return buf, nil
+}
@@ -0,0 +1,242 @@
+package ubootenv
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+	"golang.org/x/sys/unix"
+)
+
+func TestFormat(t *testing.T) {
+	env := Env{"bootdelay": "3", "bootcmd": "run distro_bootcmd", "empty": ""}
+	for _, f := range []Format{
+		{Size: 64},
+		{Size: 64, Redundant: true, ByteOrder: binary.BigEndian},
+	} {
+		buf, err := f.Encode(env, 7)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		data := "bootcmd=run distro_bootcmd\x00bootdelay=3\x00empty=\x00\x00"
+		if got := string(buf[f.headerSize() : f.headerSize()+len(data)]); got != data {
+			t.Errorf("Data: want '%q' got '%q'", data, got)
+		}
+		crc := crc32.ChecksumIEEE(buf[f.headerSize():])
+		if got := f.byteOrder().Uint32(buf); got != crc {
+			t.Errorf("CRC: want '0x%x' got '0x%x'", crc, got)
+		}
+		got, flags, err := f.Decode(buf)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, env) {
+			t.Errorf("Decode: want '%v' got '%v'", env, got)
+		}
+		if f.Redundant && flags != 7 {
+			t.Errorf("Flags: want '7' got '%v'", flags)
+		}
+
+		buf[len(buf)-1] ^= 1
+		_, _, err = f.Decode(buf)
+		if !errors.Is(err, ErrBadCRC) {
+			t.Errorf("Decode corrupt: want '%v' got '%v'", ErrBadCRC, err)
+		}
+	}
+
+	_, err := Format{Size: 16}.Encode(env, 0)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Encode too large: want '%v' got '%v'", ErrTooLarge, err)
+	}
+	_, err = Format{Size: 64}.Encode(Env{"a=b": "c"}, 0)
+	if err == nil {
+		t.Errorf("Encode invalid name succeeded")
+	}
+
+	for _, tc := range []struct {
+		a, b  byte
+		newer bool
+	}{{2, 1, true}, {1, 2, false}, {0, 255, true}, {255, 0, false}, {1, 1, false}} {
+		if newer(tc.a, tc.b) != tc.newer {
+			t.Errorf("newer(%v, %v): want '%v'", tc.a, tc.b, tc.newer)
+		}
+	}
+	for _, tc := range []struct {
+		a, b  byte
+		newer bool
+	}{{1, 0, true}, {0, 1, false}, {1, 1, false}, {0xff, 1, true}, {1, 0xff, false}, {0xff, 0xff, false}} {
+		if newerBoolean(tc.a, tc.b) != tc.newer {
+			t.Errorf("newerBoolean(%v, %v): want '%v'", tc.a, tc.b, tc.newer)
+		}
+	}
+}
+
+func newStore() (*Store, *mtdsim.Sim) {
+	erasesize := int64(mtdsim.SmallNAND.Erasesize)
+	// The first copy skips its bad first eraseblock
+	sim := mtdsim.NewSmallNAND(0)
+	return &Store{
+		Flash:  sim,
+		Format: Format{Size: 0x1000, Redundant: true},
+		Copies: []Location{{Offset: 0, Area: 2 * erasesize}, {Offset: 2 * erasesize, Area: 2 * erasesize}},
+	}, sim
+}
+
+func TestStore(t *testing.T) {
+	s, sim := newStore()
+	_, err := s.Load()
+	if !errors.Is(err, ErrBadCRC) {
+		t.Errorf("Load erased: want '%v' got '%v'", ErrBadCRC, err)
+	}
+	err = s.Set(map[string]string{"bootcount": "0", "serial#": "1234"})
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	err = s.Set(map[string]string{"bootcount": "1", "serial#": ""})
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	env, current, flags, err := s.load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := Env{"bootcount": "1"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Load: want '%v' got '%v'", want, env)
+	}
+	if current != 1 || flags != 2 {
+		t.Errorf("Current copy: want '1' with flags '2' got '%v' with flags '%v'", current, flags)
+	}
+
+	// The first copy is in the second eraseblock
+	buf := make([]byte, s.Format.Size)
+	_, err = sim.ReadAt(buf, int64(mtdsim.SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	env, _, err = s.Format.Decode(buf)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	want = Env{"bootcount": "0", "serial#": "1234"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("First copy: want '%v' got '%v'", want, env)
+	}
+
+	// An invalid current copy falls back to the other one
+	err = sim.Erase(2*int64(mtdsim.SmallNAND.Erasesize), int64(mtdsim.SmallNAND.Erasesize))
+	if err != nil {
+		t.Fatalf("Erase failed: %v", err)
+	}
+	env, err = s.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Fallback: want '%v' got '%v'", want, env)
+	}
+
+	s.Copies[0].Area = int64(mtdsim.SmallNAND.Erasesize)
+	_, err = s.Load()
+	if !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Load without good eraseblocks: want '%v' got '%v'", ErrNoSpace, err)
+	}
+}
+
+func TestStorePowerLoss(t *testing.T) {
+	s, sim := newStore()
+	old := Env{"bootcount": "0"}
+	err := s.Save(old)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	err = s.Save(old)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	workload := func(f mtdabi.Flash) error {
+		s := &Store{Flash: f, Format: s.Format, Copies: s.Copies}
+		return s.Set(map[string]string{"bootcount": "1"})
+	}
+	check := func(f mtdabi.Flash) error {
+		s := &Store{Flash: f, Format: s.Format, Copies: s.Copies}
+		env, err := s.Load()
+		if err != nil {
+			return err
+		}
+		if v := env["bootcount"]; v != "0" && v != "1" {
+			return errors.New("unexpected bootcount " + v)
+		}
+		return nil
+	}
+	failures, err := mtdsim.CheckPowerLoss(sim, workload, check, true)
+	if err != nil {
+		t.Fatalf("CheckPowerLoss failed: %v", err)
+	}
+	for _, f := range failures {
+		t.Errorf("Power loss: %v", f)
+	}
+}
+
+func TestStoreNOR(t *testing.T) {
+	info := unix.MtdInfo{Type: unix.MTD_NORFLASH, Size: 0x40000, Erasesize: 0x10000, Writesize: 1}
+	sim, err := mtdsim.New(mtdsim.Config{Info: info})
+	if err != nil {
+		t.Fatalf("Failed to create simulated MTD: %v", err)
+	}
+	s := &Store{
+		Flash:  sim,
+		Format: Format{Size: 0x1000, Redundant: true},
+		Copies: []Location{{Offset: 0}, {Offset: 0x10000}},
+	}
+	for _, bootcount := range []string{"0", "1", "2"} {
+		err = s.Set(map[string]string{"bootcount": bootcount})
+		if err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	env, current, flags, err := s.load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if env["bootcount"] != "2" || current != 0 || flags != flagActive {
+		t.Errorf("Current copy: want '0' with flags '%v' got '%v' with flags '%v', '%v'", flagActive, current, flags, env)
+	}
+	// The other copy is marked obsolete
+	buf := make([]byte, s.Format.Size)
+	_, err = sim.ReadAt(buf, 0x10000)
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	env, flags, err = s.Format.Decode(buf)
+	if err != nil || flags != flagObsolete || env["bootcount"] != "1" {
+		t.Errorf("Obsolete copy: unexpected '%v' with flags '%v', '%v'", env, flags, err)
+	}
+
+	check := func(f mtdabi.Flash) error {
+		s := &Store{Flash: f, Format: s.Format, Copies: s.Copies}
+		env, err := s.Load()
+		if err != nil {
+			return err
+		}
+		if v := env["bootcount"]; v != "2" && v != "3" {
+			return errors.New("unexpected bootcount " + v)
+		}
+		return nil
+	}
+	workload := func(f mtdabi.Flash) error {
+		s := &Store{Flash: f, Format: s.Format, Copies: s.Copies}
+		return s.Set(map[string]string{"bootcount": "3"})
+	}
+	failures, err := mtdsim.CheckPowerLoss(sim, workload, check, true)
+	if err != nil {
+		t.Fatalf("CheckPowerLoss failed: %v", err)
+	}
+	for _, f := range failures {
+		t.Errorf("Power loss: %v", f)
+	}
+}
@@ -0,0 +1,82 @@
+package mtdabi
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Errors wrapped by the pre-flight validation checks, to be tested with
+// errors.Is.
+var (
+	// ErrUnaligned means an offset or length is not a multiple of the erase
+	// block or page size.
+	ErrUnaligned = errors.New("not aligned")
+	// ErrOutOfBounds means an access extends past the end of the MTD.
+	ErrOutOfBounds = errors.New("out of bounds")
+	// ErrOOBLength means an OOB buffer does not fit the OOB area.
+	ErrOOBLength = errors.New("invalid OOB length")
+)
+
+// CheckErase checks that the region of length bytes at start can be erased:
+// it must be non-empty, aligned to info.Erasesize, and within info.Size. Use
+// Geometry.CheckErase instead for devices with erase regions.
+func CheckErase(info unix.MtdInfo, start, length int64) error {
+	g, err := NewGeometry(info, nil)
+	if err != nil {
+		return err
+	}
+	return g.CheckErase(start, length)
+}
+
+// CheckWrite checks that dataLen bytes of in-band data and oobLen bytes of OOB
+// data can be written at offset: the offset and data length must be aligned
+// to info.Writesize, the data must be within info.Size, and the OOB data must
+// fit the OOB areas of the pages written.
+func CheckWrite(info unix.MtdInfo, offset int64, dataLen, oobLen int) error {
+	if offset%int64(info.Writesize) != 0 {
+		return fmt.Errorf("write offset 0x%x %w to write size 0x%x", offset, ErrUnaligned, info.Writesize)
+	}
+	if int64(dataLen)%int64(info.Writesize) != 0 {
+		return fmt.Errorf("write length 0x%x %w to write size 0x%x", dataLen, ErrUnaligned, info.Writesize)
+	}
+	err := checkBounds(int64(info.Size), "write", offset, int64(dataLen))
+	if err != nil {
+		return err
+	}
+	pages := dataLen / int(info.Writesize)
+	if pages == 0 {
+		pages = 1
+	}
+	if oobLen > pages*int(info.Oobsize) {
+		return fmt.Errorf("write at 0x%x: %w: %v bytes exceed %v bytes available over %v page(s)",
+			offset, ErrOOBLength, oobLen, pages*int(info.Oobsize), pages)
+	}
+	return nil
+}
+
+// CheckOOB checks that an OOB access of length bytes at offset stays within
+// the OOB area of a single page and within info.Size.
+func CheckOOB(info unix.MtdInfo, offset int64, length int) error {
+	err := checkBounds(int64(info.Size), "OOB access", offset, 1)
+	if err != nil {
+		return err
+	}
+	inPage := int(offset % int64(info.Writesize))
+	if inPage+length > int(info.Oobsize) {
+		return fmt.Errorf("OOB access at 0x%x: %w: %v bytes from page offset %v exceed OOB size %v",
+			offset, ErrOOBLength, length, inPage, info.Oobsize)
+	}
+	return nil
+}
+
+// checkBounds checks that the region of length bytes at offset is within an
+// MTD of size bytes.
+func checkBounds(size int64, op string, offset, length int64) error {
+	if offset < 0 || offset+length > size {
+		return fmt.Errorf("%v of 0x%x bytes at 0x%x %w of MTD size 0x%x",
+			op, length, offset, ErrOutOfBounds, size)
+	}
+	return nil
+}
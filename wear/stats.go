@@ -0,0 +1,90 @@
+package wear
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Stats summarizes the erase counts of a set of eraseblocks.
+type Stats struct {
+	Blocks int
+	// Total is the sum of all erase counts.
+	Total    int
+	Min, Max int
+	Mean     float64
+	StdDev   float64
+	// Buckets is a histogram of the erase counts, by increasing count.
+	Buckets []Bucket
+}
+
+// Bucket is a bar of a histogram: the number of eraseblocks with an erase
+// count from Low to High inclusive.
+type Bucket struct {
+	Low, High int
+	Blocks    int
+}
+
+// Summarize computes the statistics of counts, with a histogram of up to
+// buckets bars of equal width.
+func Summarize(counts map[int64]int, buckets int) Stats {
+	s := Stats{Blocks: len(counts)}
+	if len(counts) == 0 {
+		return s
+	}
+	first := true
+	for _, c := range counts {
+		if first || c < s.Min {
+			s.Min = c
+		}
+		if first || c > s.Max {
+			s.Max = c
+		}
+		first = false
+		s.Total += c
+	}
+	s.Mean = float64(s.Total) / float64(s.Blocks)
+	var variance float64
+	for _, c := range counts {
+		d := float64(c) - s.Mean
+		variance += d * d
+	}
+	s.StdDev = math.Sqrt(variance / float64(s.Blocks))
+
+	if buckets < 1 {
+		buckets = 1
+	}
+	width := (s.Max - s.Min + buckets) / buckets
+	for low := s.Min; low <= s.Max; low += width {
+		s.Buckets = append(s.Buckets, Bucket{Low: low, High: low + width - 1})
+	}
+	for _, c := range counts {
+		s.Buckets[(c-s.Min)/width].Blocks++
+	}
+	return s
+}
+
+// WriteReport writes the statistics and the histogram as text to w.
+func (s Stats) WriteReport(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d eraseblocks, %d erases: min %d, max %d, mean %.2f, stddev %.2f\n",
+		s.Blocks, s.Total, s.Min, s.Max, s.Mean, s.StdDev)
+	most := 0
+	for _, b := range s.Buckets {
+		if b.Blocks > most {
+			most = b.Blocks
+		}
+	}
+	const barWidth = 40
+	for _, b := range s.Buckets {
+		bar := 0
+		if most > 0 {
+			bar = (b.Blocks*barWidth + most - 1) / most
+		}
+		fmt.Fprintf(&buf, "%8d-%-8d %6d %s\n", b.Low, b.High, b.Blocks, strings.Repeat("#", bar))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,87 @@
+package wear
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileStore stores erase counts in a text file, one eraseblock per line as
+// "<offset> <count>", the offset being hexadecimal with a 0x prefix. The file
+// is replaced atomically on each save, so a power cut leaves either the old
+// or the new counts.
+type FileStore struct {
+	Path string
+}
+
+// Load reads the counts from the file. A missing file holds no counts.
+func (s *FileStore) Load() (map[int64]int, error) {
+	counts := make(map[int64]int)
+	buf, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("'%v' line %v: want offset and count", s.Path, line)
+		}
+		offset, err := strconv.ParseInt(fields[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%v' line %v: %w", s.Path, line, err)
+		}
+		count, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("'%v' line %v: %w", s.Path, line, err)
+		}
+		counts[offset] = count
+	}
+	return counts, scanner.Err()
+}
+
+// Save writes the counts to a temporary file in the same directory, then
+// renames it over the file.
+func (s *FileStore) Save(counts map[int64]int) error {
+	offsets := make([]int64, 0, len(counts))
+	for offset := range counts {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	var buf bytes.Buffer
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "0x%x %d\n", offset, counts[offset])
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+// Package wear counts the erases of each eraseblock of an MTD and summarizes
+// the wear distribution, for partitions not managed by UBI, which keeps its
+// own erase counters.
+//
+// MTD has no erase counters: a Tracker wraps an mtdabi.Flash and counts the
+// erases done through it, persisting the counts in a Store such as a sidecar
+// file. Simulated devices (mtdsim.Sim) count erases natively; Counts reads
+// the counts of either.
+package wear
+
+import (
+	"fmt"
+	"sync"
+
+	mtdabi "github.com/lhl2617/go-mtd-abi"
+)
+
+// Counter is implemented by flashes that count erases, such as Tracker and
+// mtdsim.Sim.
+type Counter interface {
+	// EraseCount returns the number of times the eraseblock containing
+	// offset has been erased.
+	EraseCount(offset int64) (int, error)
+}
+
+// Store persists erase counts, keyed by eraseblock offset.
+type Store interface {
+	Load() (map[int64]int, error)
+	Save(counts map[int64]int) error
+}
+
+// Tracker is an mtdabi.Flash counting the erases done through it. It is safe
+// for concurrent use if the underlying flash is.
+type Tracker struct {
+	mtdabi.Flash
+
+	mu     sync.Mutex
+	store  Store
+	counts map[int64]int
+}
+
+var (
+	_ mtdabi.Flash = (*Tracker)(nil)
+	_ Counter      = (*Tracker)(nil)
+)
+
+// NewTracker returns a Tracker erasing f, starting from the counts loaded
+// from store. If store is nil, counts are kept in memory only.
+func NewTracker(f mtdabi.Flash, store Store) (*Tracker, error) {
+	t := &Tracker{Flash: f, store: store, counts: make(map[int64]int)}
+	if store != nil {
+		counts, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("loading erase counts: %w", err)
+		}
+		for offset, count := range counts {
+			block, err := f.Geometry().BlockAt(offset)
+			if err != nil || block.Offset != offset {
+				return nil, fmt.Errorf("loading erase counts: 0x%x is not an eraseblock", offset)
+			}
+			t.counts[offset] = count
+		}
+	}
+	return t, nil
+}
+
+// Erase erases length bytes starting at start one eraseblock at a time,
+// counting each successful erase, and saves the counts to the store. It stops
+// at the first block failing to erase.
+func (t *Tracker) Erase(start, length int64) error {
+	blocks, err := t.Geometry().Blocks(start, length)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 || blocks[0].Offset != start || blocks[len(blocks)-1].End() != start+length {
+		// Let the flash report the misalignment
+		return t.Flash.Erase(start, length)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var eraseErr error
+	erased := 0
+	for _, b := range blocks {
+		eraseErr = t.Flash.Erase(b.Offset, b.Size)
+		if eraseErr != nil {
+			break
+		}
+		t.counts[b.Offset]++
+		erased++
+	}
+	if erased > 0 && t.store != nil {
+		err = t.store.Save(t.counts)
+		if err != nil && eraseErr == nil {
+			return fmt.Errorf("saving erase counts: %w", err)
+		}
+	}
+	return eraseErr
+}
+
+// EraseCount returns the number of erases of the eraseblock containing
+// offset.
+func (t *Tracker) EraseCount(offset int64) (int, error) {
+	block, err := t.Geometry().BlockAt(offset)
+	if err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts[block.Offset], nil
+}
+
+// Counts returns the erase count of every eraseblock of f, which must count
+// erases, keyed by eraseblock offset.
+func Counts(f mtdabi.Flash) (map[int64]int, error) {
+	c, ok := f.(Counter)
+	if !ok {
+		return nil, fmt.Errorf("%T does not count erases", f)
+	}
+	blocks, err := f.Geometry().Blocks(0, f.Geometry().Size)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int, len(blocks))
+	for _, b := range blocks {
+		counts[b.Offset], err = c.EraseCount(b.Offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
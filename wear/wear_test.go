@@ -0,0 +1,109 @@
+package wear
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lhl2617/go-mtd-abi/mtdsim"
+	"golang.org/x/sys/unix"
+)
+
+func TestTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wear")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileStore{Path: filepath.Join(dir, "erase-counts")}
+
+	sim := mtdsim.NewSmallNAND()
+	tracker, err := NewTracker(sim, store)
+	if err != nil {
+		t.Fatalf("NewTracker failed: %v", err)
+	}
+	erasesize := int64(mtdsim.SmallNAND.Erasesize)
+	for i := 0; i < 3; i++ {
+		err = tracker.Erase(0, int64(mtdsim.SmallNAND.Size))
+		if err != nil {
+			t.Fatalf("Erase failed: %v", err)
+		}
+	}
+	err = tracker.Erase(erasesize, erasesize)
+	if err != nil {
+		t.Fatalf("Erase failed: %v", err)
+	}
+	// The erase stops at the failing block
+	err = sim.Inject(mtdsim.Fault{Kind: mtdsim.FaultErase, Offset: 3 * erasesize, Count: 1})
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	err = tracker.Erase(2*erasesize, 2*erasesize)
+	if err != unix.EIO {
+		t.Errorf("Erase err: want '%v' got '%v'", unix.EIO, err)
+	}
+
+	want := map[int64]int{0: 3, erasesize: 4, 2 * erasesize: 4, 3 * erasesize: 3}
+	counts, err := Counts(tracker)
+	if err != nil {
+		t.Fatalf("Counts failed: %v", err)
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("Tracker counts: want '%v' got '%v'", want, counts)
+	}
+	// The simulator counts erases natively
+	counts, err = Counts(sim)
+	if err != nil {
+		t.Fatalf("Counts failed: %v", err)
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("Simulator counts: want '%v' got '%v'", want, counts)
+	}
+
+	// Counts persist across trackers
+	fresh := mtdsim.NewSmallNAND()
+	tracker, err = NewTracker(fresh, store)
+	if err != nil {
+		t.Fatalf("NewTracker failed: %v", err)
+	}
+	count, err := tracker.EraseCount(erasesize + 1)
+	if err != nil {
+		t.Fatalf("EraseCount failed: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("EraseCount: want '4' got '%v'", count)
+	}
+
+	err = tracker.Erase(1, erasesize)
+	if err == nil {
+		t.Errorf("Unaligned erase succeeded")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	counts := map[int64]int{0: 1, 1: 2, 2: 2, 3: 9, 4: 10}
+	s := Summarize(counts, 5)
+	if s.Blocks != 5 || s.Total != 24 || s.Min != 1 || s.Max != 10 || s.Mean != 4.8 {
+		t.Errorf("Unexpected stats '%+v'", s)
+	}
+	want := []Bucket{{1, 2, 3}, {3, 4, 0}, {5, 6, 0}, {7, 8, 0}, {9, 10, 2}}
+	if !reflect.DeepEqual(s.Buckets, want) {
+		t.Errorf("Buckets: want '%v' got '%v'", want, s.Buckets)
+	}
+	var buf bytes.Buffer
+	err := s.WriteReport(&buf)
+	if err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 6 {
+		t.Errorf("Report: want 6 lines got '%v'", buf.String())
+	}
+
+	if s := Summarize(nil, 4); s.Blocks != 0 || len(s.Buckets) != 0 {
+		t.Errorf("Empty stats: got '%+v'", s)
+	}
+}